@@ -4,9 +4,12 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"text/tabwriter"
 	"time"
 
+	"github.com/mpoegel/pine/pkg/api"
 	"github.com/mpoegel/pine/pkg/arborist"
 )
 
@@ -21,6 +24,14 @@ func main() {
 
 	client := arborist.NewClient(*endpoint)
 
+	if command == "logs" {
+		if err := logs(client, flag.Args()[1:], *timeout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
 	defer cancel()
 
@@ -30,6 +41,43 @@ func main() {
 	}
 }
 
+// logs prints the output of a tree. Following is not limited by the command
+// timeout.
+func logs(client arborist.Client, args []string, timeout time.Duration) error {
+	flags := flag.NewFlagSet("logs", flag.ExitOnError)
+	follow := flags.Bool("f", false, "follow new output")
+	lines := flags.Int("n", 10, "number of lines to show, or 0 for all")
+	since := flags.String("since", "", "show output since a RFC 3339 time or a duration ago")
+	flags.Parse(args)
+
+	opts := arborist.LogOptions{
+		Lines:  *lines,
+		Follow: *follow,
+	}
+	if len(*since) > 0 {
+		if ago, err := time.ParseDuration(*since); err == nil {
+			opts.Since = time.Now().Add(-ago)
+		} else if opts.Since, err = time.Parse(time.RFC3339, *since); err != nil {
+			return fmt.Errorf("invalid since '%s'", *since)
+		}
+	}
+
+	ctx := context.Background()
+	if !opts.Follow {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	output, err := client.TreeLogs(ctx, flags.Arg(0), opts)
+	if err != nil {
+		return err
+	}
+	defer output.Close()
+	_, err = io.Copy(os.Stdout, output)
+	return err
+}
+
 func run(ctx context.Context, client arborist.Client, command, treeName string) error {
 	switch command {
 	default:
@@ -40,18 +88,31 @@ func run(ctx context.Context, client arborist.Client, command, treeName string)
 		return client.StopTree(ctx, treeName)
 	case "restart":
 		return client.RestartTree(ctx, treeName)
+	case "enable":
+		return client.EnableTree(ctx, treeName)
+	case "disable":
+		return client.DisableTree(ctx, treeName)
 	case "status":
 		if status, err := client.GetTreeStatus(ctx, treeName); err != nil {
 			return err
 		} else {
-			fmt.Printf("Tree:%s State:%s Uptime:%d LastChange:%d\n", status.TreeName, status.State, status.Uptime, status.LastChange)
+			return printStatus(status)
 		}
 	case "list":
 		if statusList, err := client.ListTrees(ctx); err != nil {
 			return err
 		} else {
 			for _, status := range statusList.Trees {
-				fmt.Printf("Tree:%s State:%s Uptime:%d LastChange:%d\n", status.TreeName, status.State, status.Uptime, status.LastChange)
+				fmt.Printf("Tree:%s State:%s Enabled:%t Uptime:%d LastChange:%d NextRun:%d LastRun:%d\n",
+					status.TreeName, status.State, status.Enabled, status.Uptime, status.LastChange, status.NextRun, status.LastRun)
+			}
+		}
+	case "output":
+		if output, err := client.GetTreeOutput(ctx, treeName); err != nil {
+			return err
+		} else {
+			for _, line := range output.Lines {
+				fmt.Println(line)
 			}
 		}
 	case "logrotate":
@@ -60,3 +121,39 @@ func run(ctx context.Context, client arborist.Client, command, treeName string)
 
 	return nil
 }
+
+// printStatus prints each field of the tree's status on its own line.
+func printStatus(status *api.TreeStatusResponse) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, field := range []struct {
+		name  string
+		value any
+	}{
+		{"Tree", status.TreeName},
+		{"State", status.State},
+		{"Enabled", status.Enabled},
+		{"Health", status.Health},
+		{"Uptime", status.Uptime},
+		{"LastChange", status.LastChange},
+		{"Pid", status.Pid},
+		{"Runs", status.RunCount},
+		{"ExitCode", status.ExitCode},
+		{"ExitSignal", status.ExitSignal},
+		{"ExitReason", status.ExitReason},
+		{"NextRestart", status.NextRestart},
+		{"NextRun", status.NextRun},
+		{"LastRun", status.LastRun},
+		{"LastError", fmt.Sprintf("%q", status.LastError)},
+		{"StatusText", fmt.Sprintf("%q", status.StatusText)},
+		{"LastOutput", fmt.Sprintf("%q", status.LastOutput)},
+		{"Limits", fmt.Sprintf("%q", status.Limits)},
+		{"Cgroup", status.Cgroup},
+		{"MemoryCurrent", status.MemoryCurrent},
+		{"MemoryPeak", status.MemoryPeak},
+		{"CPUUsageUsec", status.CPUUsageUsec},
+		{"OOMKills", status.OOMKills},
+	} {
+		fmt.Fprintf(w, "%s:\t%v\n", field.name, field.value)
+	}
+	return w.Flush()
+}
@@ -2,6 +2,8 @@ module github.com/mpoegel/pine
 
 go 1.25.5
 
-require github.com/fsnotify/fsnotify v1.9.0
-
-require golang.org/x/sys v0.13.0 // indirect
+require (
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/klauspost/compress v1.20.1
+	golang.org/x/sys v0.13.0
+)
@@ -15,6 +15,8 @@ func main() {
 	config := pine.Config{}
 	flag.StringVar(&config.TreeDir, "d", "/usr/local/etc/forest.d", "directory to find service configs")
 	flag.StringVar(&config.UdsEndpoint, "e", "/var/run/pine.sock", "UDS endpoint for talking to pine")
+	flag.StringVar(&config.RuntimeDir, "r", "/run/pine", "directory for runtime files such as notify sockets")
+	flag.StringVar(&config.StateDir, "s", "/var/lib/pine", "directory for state kept across restarts")
 	flag.BoolVar(&config.UnprivilegedMode, "unprivileged", false, "run as unprivileged user")
 
 	flag.Parse()
@@ -3,8 +3,34 @@ package api
 type TreeStatusResponse struct {
 	TreeName   string `json:"name"`
 	State      string `json:"status"`
+	StatusText string `json:"statusText"`
 	LastChange uint64 `json:"lastChange"`
 	Uptime     uint64 `json:"uptime"`
+
+	Pid         int      `json:"pid"`
+	RunCount    int      `json:"runCount"`
+	ExitCode    int      `json:"exitCode"`
+	ExitSignal  string   `json:"exitSignal"`
+	ExitReason  string   `json:"exitReason"`
+	Health      string   `json:"health"`
+	LastError   string   `json:"lastError"`
+	LastOutput  []string `json:"lastOutput"`
+	Limits      []string `json:"limits"`
+	NextRestart uint64   `json:"nextRestart"`
+	Enabled     bool     `json:"enabled"`
+	NextRun     uint64   `json:"nextRun"`
+	LastRun     uint64   `json:"lastRun"`
+
+	Cgroup        string `json:"cgroup"`
+	MemoryCurrent uint64 `json:"memoryCurrent"`
+	MemoryPeak    uint64 `json:"memoryPeak"`
+	CPUUsageUsec  uint64 `json:"cpuUsageUsec"`
+	OOMKills      uint64 `json:"oomKills"`
+}
+
+type TreeOutputResponse struct {
+	TreeName string   `json:"name"`
+	Lines    []string `json:"lines"`
 }
 
 type ListTreesResponse struct {
@@ -4,8 +4,13 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	api "github.com/mpoegel/pine/pkg/api"
 )
@@ -17,6 +22,17 @@ type Client interface {
 	GetTreeStatus(ctx context.Context, name string) (*api.TreeStatusResponse, error)
 	ListTrees(ctx context.Context) (*api.ListTreesResponse, error)
 	RotateTreeLog(ctx context.Context, name string) error
+	EnableTree(ctx context.Context, name string) error
+	DisableTree(ctx context.Context, name string) error
+	TreeLogs(ctx context.Context, name string, opts LogOptions) (io.ReadCloser, error)
+	GetTreeOutput(ctx context.Context, name string) (*api.TreeOutputResponse, error)
+}
+
+// LogOptions selects the output of a tree returned by TreeLogs.
+type LogOptions struct {
+	Lines  int       // only the last lines, or all output if 0
+	Since  time.Time // only output written since, if set
+	Follow bool      // keep streaming new output until the context is done
 }
 
 type ClientImpl struct {
@@ -155,3 +171,96 @@ func (c *ClientImpl) RotateTreeLog(ctx context.Context, name string) error {
 
 	return nil
 }
+
+func (c *ClientImpl) EnableTree(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/tree/enable/"+name, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pine returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (c *ClientImpl) DisableTree(ctx context.Context, name string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/tree/disable/"+name, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("pine returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func (c *ClientImpl) TreeLogs(ctx context.Context, name string, opts LogOptions) (io.ReadCloser, error) {
+	query := url.Values{}
+	if opts.Lines > 0 {
+		query.Set("lines", strconv.Itoa(opts.Lines))
+	}
+	if !opts.Since.IsZero() {
+		query.Set("since", opts.Since.Format(time.RFC3339Nano))
+	}
+	if opts.Follow {
+		query.Set("follow", "true")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/tree/"+name+"/logs?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		if msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096)); len(msg) > 0 {
+			return nil, fmt.Errorf("pine returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		return nil, fmt.Errorf("pine returned %s", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+func (c *ClientImpl) GetTreeOutput(ctx context.Context, name string) (*api.TreeOutputResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/tree/"+name+"/output", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("pine returned %s", resp.Status)
+	}
+
+	res := &api.TreeOutputResponse{}
+	decoder := json.NewDecoder(resp.Body)
+	defer resp.Body.Close()
+	if err := decoder.Decode(res); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
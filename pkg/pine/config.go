@@ -3,5 +3,7 @@ package pine
 type Config struct {
 	TreeDir          string
 	UdsEndpoint      string
+	RuntimeDir       string
+	StateDir         string
 	UnprivilegedMode bool
 }
@@ -3,13 +3,19 @@ package pine
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"maps"
 	"net"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	fsnotify "github.com/fsnotify/fsnotify"
@@ -17,24 +23,49 @@ import (
 )
 
 const (
-	flushInterval = 5 * time.Second
+	flushInterval          = 5 * time.Second
+	dependencyPollInterval = 100 * time.Millisecond
 )
 
+// ErrTreeNotFound is returned for operations on a tree that pine does not know.
+var ErrTreeNotFound = errors.New("tree not found")
+
 type Daemon struct {
 	config Config
 
 	treeLock sync.RWMutex
 	trees    map[string]tree.Tree
 
-	wg sync.WaitGroup
+	runLock     sync.Mutex
+	runs        map[string]*treeRun
+	manualStops map[string]bool
+	enabled     map[string]bool // overrides the AutoStart of a tree
+
+	scheduleLock sync.Mutex
+	schedules    map[string]*treeSchedule
+
+	stopping atomic.Bool
+	wg       sync.WaitGroup
+}
+
+// treeRun tracks a tree started by the daemon until its Start returns.
+type treeRun struct {
+	done      chan struct{}
+	cancel    context.CancelFunc
+	stopped   bool
+	succeeded bool // set before done is closed
 }
 
 func NewDaemon(config Config) *Daemon {
 	return &Daemon{
-		config:   config,
-		treeLock: sync.RWMutex{},
-		trees:    map[string]tree.Tree{},
-		wg:       sync.WaitGroup{},
+		config:      config,
+		treeLock:    sync.RWMutex{},
+		trees:       map[string]tree.Tree{},
+		runs:        map[string]*treeRun{},
+		manualStops: map[string]bool{},
+		enabled:     map[string]bool{},
+		schedules:   map[string]*treeSchedule{},
+		wg:          sync.WaitGroup{},
 	}
 }
 
@@ -50,8 +81,11 @@ func (d *Daemon) Run(ctx context.Context) error {
 		}
 		tree.DefaultUser = currUser.Username
 	}
+	if len(d.config.RuntimeDir) > 0 {
+		tree.RuntimeDir = d.config.RuntimeDir
+	}
 
-	ln, err := net.Listen("unix", d.config.UdsEndpoint)
+	ln, err := listenUnix(d.config.UdsEndpoint)
 	if err != nil {
 		return err
 	}
@@ -66,18 +100,51 @@ func (d *Daemon) Run(ctx context.Context) error {
 		d.rotateTreeLogFiles(ctx)
 	})
 
-	if err := d.findTrees(ctx); err != nil {
+	state := d.loadState()
+	for name, saved := range state.Trees {
+		if saved.Stopped {
+			d.manualStops[name] = true
+		}
+		if saved.Enabled != nil {
+			d.enabled[name] = *saved.Enabled
+		}
+	}
+	if err := d.findTrees(ctx, state); err != nil {
 		return err
 	}
+	d.wg.Go(func() {
+		d.persistState(ctx)
+	})
 
 	<-ctx.Done()
 	d.stop(context.Background())
 	d.wg.Wait()
+	if err := d.saveState(context.Background()); err != nil {
+		slog.Warn("failed to save state", "err", err)
+	}
 	slog.Info("daemon finished")
 	return nil
 }
 
-func (d *Daemon) findTrees(ctx context.Context) error {
+// listenUnix listens on the socket at endpoint. A socket left behind by a pine
+// that crashed is replaced, so that the next pine can adopt its trees, while
+// a socket another pine still listens on is an error.
+func listenUnix(endpoint string) (net.Listener, error) {
+	if conn, err := net.Dial("unix", endpoint); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another pine is listening on %s", endpoint)
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		if stat, err := os.Lstat(endpoint); err == nil && stat.Mode().Type() == os.ModeSocket {
+			slog.Info("removing stale socket", "endpoint", endpoint)
+			if err := os.Remove(endpoint); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return net.Listen("unix", endpoint)
+}
+
+func (d *Daemon) findTrees(ctx context.Context, state daemonState) error {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return err
@@ -92,7 +159,14 @@ func (d *Daemon) findTrees(ctx context.Context) error {
 		if stat, err := os.Stat(filename); err == nil && stat.IsDir() {
 			continue
 		}
-		d.loadTree(ctx, filename)
+		d.addTree(ctx, filename)
+	}
+	for _, name := range d.sortedTrees(ctx) {
+		if d.adoptTree(ctx, name, state) {
+			d.scheduleTree(ctx, name)
+			continue
+		}
+		d.autoStartTree(ctx, name)
 	}
 
 	d.wg.Go(func() {
@@ -108,7 +182,10 @@ func (d *Daemon) findTrees(ctx context.Context) error {
 				if !ok {
 					return
 				}
-				if event.Has(fsnotify.Write) {
+				if event.Has(fsnotify.Write) && !d.hasTreeFile(event.Name) {
+					// the file was empty or invalid when it was created
+					d.loadTree(ctx, event.Name)
+				} else if event.Has(fsnotify.Write) {
 					updateQueueLock.Lock()
 					updateQueue[event.Name] = true
 					updateQueueLock.Unlock()
@@ -139,27 +216,113 @@ func (d *Daemon) findTrees(ctx context.Context) error {
 }
 
 func (d *Daemon) loadTree(ctx context.Context, filename string) {
+	name, ok := d.addTree(ctx, filename)
+	if !ok {
+		return
+	}
+
+	if _, err := sortTrees(d.treeConfigs()); err != nil {
+		slog.Error("rejecting tree", "filename", filename, "name", name, "err", err)
+		d.treeLock.Lock()
+		d.trees[name].Destroy(ctx)
+		delete(d.trees, name)
+		d.treeLock.Unlock()
+		return
+	}
+
+	d.autoStartTree(ctx, name)
+}
+
+// autoStartTree starts name once it is loaded, unless it runs on a schedule,
+// is disabled, or was stopped manually.
+func (d *Daemon) autoStartTree(ctx context.Context, name string) {
+	if d.scheduleTree(ctx, name) {
+		return
+	}
+	d.treeLock.RLock()
+	t, ok := d.trees[name]
+	d.treeLock.RUnlock()
+	if !ok {
+		return
+	}
+	if !d.isEnabled(t.Config()) {
+		slog.Info("not starting disabled tree", "name", name)
+		return
+	}
+	d.runLock.Lock()
+	stopped := d.manualStops[name]
+	d.runLock.Unlock()
+	if stopped {
+		slog.Info("not starting manually stopped tree", "name", name)
+		return
+	}
+	if err := d.StartTree(ctx, name); err != nil {
+		slog.Warn("failed to start tree", "name", name, "err", err)
+	}
+}
+
+// addTree loads the tree config in filename without starting the tree.
+func (d *Daemon) addTree(ctx context.Context, filename string) (string, bool) {
 	slog.Info("adding new tree", "filename", filename)
 
 	d.treeLock.Lock()
+	defer d.treeLock.Unlock()
 	t, err := tree.NewTree(filename)
 	if err != nil {
 		slog.Warn("failed to create new tree", "filename", filename, "err", err)
-		d.treeLock.Unlock()
-		return
+		return "", false
 	}
 
 	name := t.Config().Name
 	if ot, ok := d.trees[name]; ok {
 		slog.Warn("conflicting tree names", "filename", filename, "name", name, "existing", ot.Config().OriginFile)
 		t.Destroy(ctx)
-		d.treeLock.Unlock()
-		return
+		return "", false
 	}
 	d.trees[name] = t
-	d.treeLock.Unlock()
+	return name, true
+}
+
+// sortedTrees returns the names of all trees in dependency order. Trees that
+// form a dependency cycle are rejected and removed.
+func (d *Daemon) sortedTrees(ctx context.Context) []string {
+	for {
+		order, err := sortTrees(d.treeConfigs())
+		var cycleErr *dependencyCycleError
+		if !errors.As(err, &cycleErr) {
+			return order
+		}
+		slog.Error("rejecting trees", "err", err)
+		d.treeLock.Lock()
+		for _, name := range cycleErr.cycle {
+			if t, ok := d.trees[name]; ok {
+				t.Destroy(ctx)
+				delete(d.trees, name)
+			}
+		}
+		d.treeLock.Unlock()
+	}
+}
 
-	d.StartTree(ctx, name)
+func (d *Daemon) treeConfigs() map[string]tree.Config {
+	d.treeLock.RLock()
+	defer d.treeLock.RUnlock()
+	configs := make(map[string]tree.Config, len(d.trees))
+	for name, t := range d.trees {
+		configs[name] = t.Config()
+	}
+	return configs
+}
+
+func (d *Daemon) hasTreeFile(filename string) bool {
+	d.treeLock.RLock()
+	defer d.treeLock.RUnlock()
+	for _, t := range d.trees {
+		if t.Config().OriginFile == filename {
+			return true
+		}
+	}
+	return false
 }
 
 func (d *Daemon) updateTree(ctx context.Context, filename string) {
@@ -172,15 +335,23 @@ func (d *Daemon) updateTree(ctx context.Context, filename string) {
 	}
 	name := newConfig.Name
 
+	configs := d.treeConfigs()
+	configs[name] = newConfig
+	if _, err := sortTrees(configs); err != nil {
+		slog.Error("cannot update tree", "name", name, "err", err)
+		return
+	}
+
 	d.treeLock.RLock()
 	t, ok := d.trees[name]
+	d.treeLock.RUnlock()
 	if !ok {
 		slog.Warn("tree not found to update", "name", name, "filename", filename)
 		return
 	}
 
 	t.Reload(ctx)
-	d.treeLock.RUnlock()
+	d.scheduleTree(ctx, name)
 }
 
 func (d *Daemon) removeTree(ctx context.Context, filename string) {
@@ -201,18 +372,37 @@ func (d *Daemon) removeTree(ctx context.Context, filename string) {
 		return
 	}
 
+	d.unscheduleTree(cfg.Name)
 	t.Destroy(ctx)
 	delete(d.trees, cfg.Name)
 }
 
+// stop destroys all trees in reverse dependency order, waiting for the
+// dependents of a tree to finish before stopping it.
 func (d *Daemon) stop(ctx context.Context) {
-	d.treeLock.Lock()
-	defer d.treeLock.Unlock()
-
 	slog.Info("shutting down daemon")
+	d.stopping.Store(true)
 
-	for _, t := range d.trees {
-		t.Destroy(ctx)
+	d.treeLock.RLock()
+	trees := maps.Clone(d.trees)
+	d.treeLock.RUnlock()
+
+	configs := d.treeConfigs()
+	order, err := sortTrees(configs)
+	if err != nil {
+		slog.Warn("cannot order trees for shutdown", "err", err)
+		order = slices.Collect(maps.Keys(trees))
+	}
+	slices.Reverse(order)
+
+	for _, name := range order {
+		for _, dependent := range orderedAfter(configs, name) {
+			d.waitStopped(dependent)
+		}
+		d.cancelRun(name)
+		if t, ok := trees[name]; ok {
+			t.Destroy(ctx)
+		}
 	}
 }
 
@@ -222,40 +412,257 @@ func (d *Daemon) StartTree(ctx context.Context, name string) error {
 	d.treeLock.RUnlock()
 
 	if !ok {
-		return errors.New("tree not found")
+		return ErrTreeNotFound
+	}
+
+	d.runLock.Lock()
+	delete(d.manualStops, name)
+	prev, running := d.runs[name]
+	d.runLock.Unlock()
+	if running && !prev.stopped {
+		return nil
+	} else if running {
+		// wait for the previous run to wind down before starting again
+		select {
+		case <-prev.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 
+	cfg := t.Config()
+	for _, dep := range slices.Concat(cfg.Requires, cfg.BindsTo) {
+		if err := d.StartTree(ctx, dep); err != nil {
+			return fmt.Errorf("cannot start required tree '%s': %w", dep, err)
+		}
+	}
+	for _, dep := range cfg.Wants {
+		if err := d.StartTree(ctx, dep); err != nil {
+			slog.Warn("cannot start wanted tree", "name", name, "wants", dep, "err", err)
+		}
+	}
+
+	d.runLock.Lock()
+	if _, running := d.runs[name]; running {
+		d.runLock.Unlock()
+		return nil
+	}
+	runCtx, cancel := context.WithCancel(ctx)
+	run := &treeRun{
+		done:   make(chan struct{}),
+		cancel: cancel,
+	}
+	d.runs[name] = run
+	d.runLock.Unlock()
+
 	d.wg.Go(func() {
-		err := t.Start(ctx)
+		defer func() {
+			cancel()
+			d.runLock.Lock()
+			delete(d.runs, name)
+			d.runLock.Unlock()
+			close(run.done)
+		}()
+
+		if err := d.waitForDependencies(runCtx, cfg); err != nil {
+			slog.Warn("not starting tree", "name", name, "err", err)
+			return
+		}
+		err := t.Start(runCtx)
 		slog.Info("tree finished", "name", name, "err", err)
+		if status, err := t.Status(ctx); err == nil {
+			run.succeeded = status.State == tree.SucceededState
+		}
+
+		if !d.stopping.Load() {
+			d.stopBoundTrees(ctx, name)
+		}
 	})
 	return nil
 }
 
-func (d *Daemon) StopTree(ctx context.Context, name string) error {
+// waitForDependencies blocks until every tree that cfg is ordered after is
+// running, or has succeeded if it is a oneshot tree. Trees that are not being started are skipped unless they are
+// required.
+func (d *Daemon) waitForDependencies(ctx context.Context, cfg tree.Config) error {
+	for _, dep := range cfg.Dependencies() {
+		if err := d.waitRunning(ctx, dep); err != nil {
+			if slices.Contains(cfg.Requires, dep) || slices.Contains(cfg.BindsTo, dep) {
+				return fmt.Errorf("required tree '%s' is not running: %w", dep, err)
+			}
+			slog.Debug("not waiting for tree", "name", cfg.Name, "after", dep, "err", err)
+		}
+	}
+	return nil
+}
+
+func (d *Daemon) waitRunning(ctx context.Context, name string) error {
+	ticker := time.NewTicker(dependencyPollInterval)
+	defer ticker.Stop()
+	for {
+		d.runLock.Lock()
+		run, ok := d.runs[name]
+		d.runLock.Unlock()
+		if !ok {
+			return errors.New("tree is not started")
+		}
+
+		status, err := d.GetTreeStatus(ctx, name)
+		if err != nil {
+			return err
+		}
+		// a oneshot tree only stays succeeded while its run is active if it
+		// remains after exit, otherwise its run has to finish first
+		if status.State == tree.RunningState || (status.State == tree.SucceededState && status.For.RemainAfterExit) {
+			return nil
+		}
+
+		select {
+		case <-run.done:
+			if run.succeeded {
+				return nil
+			} else if status, err := d.GetTreeStatus(ctx, name); err == nil && status.State == tree.FailedState {
+				return fmt.Errorf("tree failed with exit code %d", status.ExitCode)
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (d *Daemon) waitStopped(name string) {
+	d.runLock.Lock()
+	run, ok := d.runs[name]
+	d.runLock.Unlock()
+	if ok {
+		<-run.done
+	}
+}
+
+func (d *Daemon) isRunning(name string) bool {
+	d.runLock.Lock()
+	defer d.runLock.Unlock()
+	run, ok := d.runs[name]
+	return ok && !run.stopped
+}
+
+// stopBoundTrees stops the trees bound to name after it finished on its own.
+func (d *Daemon) stopBoundTrees(ctx context.Context, name string) {
+	for other, cfg := range d.treeConfigs() {
+		if slices.Contains(cfg.BindsTo, name) && d.isRunning(other) {
+			slog.Info("stopping bound tree", "name", other, "bindsTo", name)
+			d.stopTree(ctx, other, false)
+		}
+	}
+}
+
+// EnableTree makes name start whenever pine loads it, or run on its schedule.
+// It does not start a tree that is not scheduled.
+func (d *Daemon) EnableTree(ctx context.Context, name string) error {
+	return d.setEnabled(ctx, name, true)
+}
+
+// DisableTree keeps name from starting when pine loads it and stops its
+// schedule. It does not stop a running tree.
+func (d *Daemon) DisableTree(ctx context.Context, name string) error {
+	return d.setEnabled(ctx, name, false)
+}
+
+func (d *Daemon) setEnabled(ctx context.Context, name string, enabled bool) error {
 	d.treeLock.RLock()
-	defer d.treeLock.RUnlock()
-	t, ok := d.trees[name]
+	_, ok := d.trees[name]
+	d.treeLock.RUnlock()
 	if !ok {
-		return errors.New("tree not found")
+		return ErrTreeNotFound
+	}
+
+	slog.Info("setting tree enabled", "name", name, "enabled", enabled)
+	d.runLock.Lock()
+	d.enabled[name] = enabled
+	d.runLock.Unlock()
+	if enabled {
+		d.scheduleTree(ctx, name)
 	} else {
-		t.Stop(ctx)
+		d.unscheduleTree(name)
 	}
 	return nil
 }
 
+// isEnabled tells whether the tree of cfg starts automatically.
+func (d *Daemon) isEnabled(cfg tree.Config) bool {
+	d.runLock.Lock()
+	defer d.runLock.Unlock()
+	if enabled, ok := d.enabled[cfg.Name]; ok {
+		return enabled
+	}
+	return cfg.AutoStart
+}
+
+func (d *Daemon) StopTree(ctx context.Context, name string) error {
+	return d.stopTree(ctx, name, true)
+}
+
+// stopTree stops name and the trees that require it. Manually stopped trees
+// stay stopped when pine restarts.
+func (d *Daemon) stopTree(ctx context.Context, name string, manual bool) error {
+	d.treeLock.RLock()
+	t, ok := d.trees[name]
+	d.treeLock.RUnlock()
+	if !ok {
+		return ErrTreeNotFound
+	}
+
+	for _, dependent := range requiredBy(d.treeConfigs(), name) {
+		if d.isRunning(dependent) {
+			slog.Info("stopping dependent tree", "name", dependent, "requires", name)
+			d.stopTree(ctx, dependent, manual)
+		}
+	}
+
+	if manual {
+		d.runLock.Lock()
+		d.manualStops[name] = true
+		d.runLock.Unlock()
+	}
+	d.cancelRun(name)
+	return t.Stop(ctx)
+}
+
+// cancelRun marks the run of name as stopped and cancels its context, which
+// also aborts waiting for its dependencies.
+func (d *Daemon) cancelRun(name string) {
+	d.runLock.Lock()
+	defer d.runLock.Unlock()
+	if run, ok := d.runs[name]; ok {
+		run.stopped = true
+		run.cancel()
+	}
+}
+
 func (d *Daemon) RestartTree(ctx context.Context, name string) error {
 	d.treeLock.RLock()
-	defer d.treeLock.RUnlock()
 	t, ok := d.trees[name]
+	d.treeLock.RUnlock()
 	if !ok {
-		return errors.New("tree not found")
+		return ErrTreeNotFound
 	} else if t.Config().Restart == tree.NeverRestart {
 		return errors.New("cannot restart")
-	} else {
-		t.Restart(ctx)
 	}
-	return nil
+
+	// dependents are stopped and started again once this tree is back up
+	for _, dependent := range requiredBy(d.treeConfigs(), name) {
+		if d.isRunning(dependent) {
+			slog.Info("restarting dependent tree", "name", dependent, "requires", name)
+			d.stopTree(ctx, dependent, false)
+			d.wg.Go(func() {
+				if err := d.StartTree(ctx, dependent); err != nil {
+					slog.Warn("failed to start dependent tree", "name", dependent, "err", err)
+				}
+			})
+		}
+	}
+	return t.Restart(ctx)
 }
 
 func (d *Daemon) GetTreeStatus(ctx context.Context, name string) (*tree.Status, error) {
@@ -263,10 +670,14 @@ func (d *Daemon) GetTreeStatus(ctx context.Context, name string) (*tree.Status,
 	defer d.treeLock.RUnlock()
 	t, ok := d.trees[name]
 	if !ok {
-		return nil, errors.New("tree not found")
-	} else {
-		return t.Status(ctx)
+		return nil, ErrTreeNotFound
+	}
+	status, err := t.Status(ctx)
+	if err == nil {
+		status.Enabled = d.isEnabled(*status.For)
+		d.scheduleStatus(status)
 	}
+	return status, err
 }
 
 func (d *Daemon) rotateTreeLogFiles(ctx context.Context) {
@@ -278,8 +689,9 @@ func (d *Daemon) rotateTreeLogFiles(ctx context.Context) {
 		case <-timer.C:
 			slog.Info("rotating tree logs")
 			d.treeLock.RLock()
-			defer d.treeLock.RUnlock()
-			for name, t := range d.trees {
+			trees := maps.Clone(d.trees)
+			d.treeLock.RUnlock()
+			for name, t := range trees {
 				if err := t.RotateLog(); err != nil {
 					slog.Warn("failed to rotate logfile", "name", name, "err", err)
 				}
@@ -299,18 +711,42 @@ func (d *Daemon) ListTrees(ctx context.Context) ([]*tree.Status, error) {
 		if statusErr != nil {
 			err = errors.Join(err)
 		} else {
+			status.Enabled = d.isEnabled(*status.For)
+			d.scheduleStatus(status)
 			res = append(res, status)
 		}
 	}
 	return res, err
 }
 
+// GetTreeOutput returns the recent output of name kept in memory.
+func (d *Daemon) GetTreeOutput(ctx context.Context, name string) ([]string, error) {
+	d.treeLock.RLock()
+	t, ok := d.trees[name]
+	d.treeLock.RUnlock()
+	if !ok {
+		return nil, ErrTreeNotFound
+	}
+	return t.RecentOutput(), nil
+}
+
+// TreeLogs returns the output of name selected by opts.
+func (d *Daemon) TreeLogs(ctx context.Context, name string, opts tree.LogOptions) (io.ReadCloser, error) {
+	d.treeLock.RLock()
+	t, ok := d.trees[name]
+	d.treeLock.RUnlock()
+	if !ok {
+		return nil, ErrTreeNotFound
+	}
+	return t.Logs(ctx, opts)
+}
+
 func (d *Daemon) RotateTreeLog(ctx context.Context, name string) error {
 	d.treeLock.RLock()
 	defer d.treeLock.RUnlock()
 	t, ok := d.trees[name]
 	if !ok {
-		return errors.New("tree not found")
+		return ErrTreeNotFound
 	} else {
 		return t.RotateLog()
 	}
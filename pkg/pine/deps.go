@@ -0,0 +1,93 @@
+package pine
+
+import (
+	"slices"
+	"strings"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+type dependencyCycleError struct {
+	cycle []string
+}
+
+func (e *dependencyCycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.cycle, " -> ")
+}
+
+// sortTrees orders the trees so that each tree comes after every tree it
+// depends on. Dependencies on trees that are not loaded are ignored. If the
+// dependencies form a cycle, a *dependencyCycleError naming it is returned.
+func sortTrees(configs map[string]tree.Config) ([]string, error) {
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	marks := map[string]int{}
+	order := []string{}
+	path := []string{}
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch marks[name] {
+		case visited:
+			return nil
+		case visiting:
+			start := slices.Index(path, name)
+			cycle := append(slices.Clone(path[start:]), name)
+			return &dependencyCycleError{cycle: cycle}
+		}
+		marks[name] = visiting
+		path = append(path, name)
+		for _, dep := range configs[name].Dependencies() {
+			if _, ok := configs[dep]; !ok {
+				continue
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		marks[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// requiredBy returns the trees that require or are bound to name.
+func requiredBy(configs map[string]tree.Config, name string) []string {
+	res := []string{}
+	for other, cfg := range configs {
+		if slices.Contains(cfg.Requires, name) || slices.Contains(cfg.BindsTo, name) {
+			res = append(res, other)
+		}
+	}
+	slices.Sort(res)
+	return res
+}
+
+// orderedAfter returns the trees that are ordered after name.
+func orderedAfter(configs map[string]tree.Config, name string) []string {
+	res := []string{}
+	for other, cfg := range configs {
+		if slices.Contains(cfg.Dependencies(), name) {
+			res = append(res, other)
+		}
+	}
+	slices.Sort(res)
+	return res
+}
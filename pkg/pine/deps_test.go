@@ -0,0 +1,145 @@
+package pine_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	pine "github.com/mpoegel/pine/pkg/pine"
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+// writeTree writes a tree config that logs into dir.
+func writeTree(t *testing.T, dir string, name string, contents string) {
+	contents = "Name " + name + "\nLogFile " + filepath.Join(dir, name+".log") + "\n" + contents
+	noErr(t, os.WriteFile(filepath.Join(dir, name+".tree"), []byte(contents), 0644))
+}
+
+// runDaemon runs an unprivileged daemon on dir until the test ends.
+func runDaemon(t *testing.T, dir string) *pine.Daemon {
+	daemon, stop := startDaemon(dir)
+	t.Cleanup(stop)
+	return daemon
+}
+
+// startDaemon runs an unprivileged daemon on dir until stop is called.
+func startDaemon(dir string) (*pine.Daemon, func()) {
+	daemon := pine.NewDaemon(pine.Config{
+		TreeDir:          dir,
+		UdsEndpoint:      filepath.Join(dir, "pine.sock"),
+		StateDir:         dir,
+		UnprivilegedMode: true,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- daemon.Run(ctx)
+	}()
+	return daemon, sync.OnceFunc(func() {
+		cancel()
+		<-errCh
+	})
+}
+
+func treeState(t *testing.T, daemon *pine.Daemon, name string) tree.State {
+	status, err := daemon.GetTreeStatus(context.Background(), name)
+	if err != nil {
+		t.Fatalf("tree %s: %v", name, err)
+	}
+	return status.State
+}
+
+func TestDependencyOrder(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTree(t, tmpDir, "app", "Command sleep 30\nRequires db\n")
+	writeTree(t, tmpDir, "db", "Command sleep 30\n")
+	daemon := runDaemon(t, tmpDir)
+
+	time.Sleep(500 * time.Millisecond)
+
+	app, err := daemon.GetTreeStatus(context.Background(), "app")
+	noErr(t, err)
+	db, err := daemon.GetTreeStatus(context.Background(), "db")
+	noErr(t, err)
+	if app.State != tree.RunningState || db.State != tree.RunningState {
+		t.Fatalf("trees not running: app=%s db=%s", app.State, db.State)
+	}
+	if !db.LastChange.Before(app.LastChange) {
+		t.Errorf("app started before db: app=%s db=%s", app.LastChange, db.LastChange)
+	}
+
+	noErr(t, daemon.StopTree(context.Background(), "db"))
+	time.Sleep(300 * time.Millisecond)
+	if state := treeState(t, daemon, "app"); state != tree.StoppedState {
+		t.Errorf("dependent tree was not stopped: %s", state)
+	}
+
+	// starting the dependent pulls its requirement back in
+	noErr(t, daemon.StartTree(context.Background(), "app"))
+	time.Sleep(500 * time.Millisecond)
+	if state := treeState(t, daemon, "db"); state != tree.RunningState {
+		t.Errorf("required tree was not started: %s", state)
+	}
+}
+
+func TestBindsToStopsDependents(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTree(t, tmpDir, "db", "Command sleep 0.5\n")
+	writeTree(t, tmpDir, "app", "Command sleep 30\nBindsTo db\n")
+	daemon := runDaemon(t, tmpDir)
+
+	time.Sleep(300 * time.Millisecond)
+	if state := treeState(t, daemon, "app"); state != tree.RunningState {
+		t.Fatalf("app not running: %s", state)
+	}
+
+	time.Sleep(700 * time.Millisecond)
+	if state := treeState(t, daemon, "app"); state != tree.StoppedState {
+		t.Errorf("bound tree was not stopped: %s", state)
+	}
+}
+
+func TestDependencyCycle(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTree(t, tmpDir, "a", "Command sleep 30\nAfter b\n")
+	writeTree(t, tmpDir, "b", "Command sleep 30\nRequires a\n")
+	writeTree(t, tmpDir, "c", "Command sleep 30\nWants a\n")
+	daemon := runDaemon(t, tmpDir)
+
+	time.Sleep(300 * time.Millisecond)
+	for _, name := range []string{"a", "b"} {
+		if _, err := daemon.GetTreeStatus(context.Background(), name); err == nil {
+			t.Errorf("tree %s in a dependency cycle was loaded", name)
+		}
+	}
+	if state := treeState(t, daemon, "c"); state != tree.RunningState {
+		t.Errorf("unexpected state for c: %s", state)
+	}
+}
+
+func TestDependencyOnOneshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	marker := filepath.Join(tmpDir, "migrated")
+	writeTree(t, tmpDir, "migrate", "Type oneshot\nCommand sh -c 'sleep 0.3 && touch "+marker+"'\n")
+	writeTree(t, tmpDir, "app", "Command sh -c 'test -f "+marker+" && exec sleep 30'\nRequires migrate\n")
+	writeTree(t, tmpDir, "broken", "Type oneshot\nCommand sh -c 'exit 4'\n")
+	writeTree(t, tmpDir, "worker", "Command sleep 30\nRequires broken\n")
+	daemon := runDaemon(t, tmpDir)
+
+	time.Sleep(time.Second)
+	if state := treeState(t, daemon, "migrate"); state != tree.SucceededState {
+		t.Errorf("unexpected oneshot state: %s", state)
+	}
+	if state := treeState(t, daemon, "app"); state != tree.RunningState {
+		t.Errorf("app did not start after its oneshot requirement: %s", state)
+	}
+	if state := treeState(t, daemon, "broken"); state != tree.FailedState {
+		t.Errorf("unexpected failed oneshot state: %s", state)
+	}
+	if state := treeState(t, daemon, "worker"); state != tree.StoppedState {
+		t.Errorf("worker started despite its requirement failing: %s", state)
+	}
+}
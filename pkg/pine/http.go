@@ -3,9 +3,15 @@ package pine
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	api "github.com/mpoegel/pine/pkg/api"
 	tree "github.com/mpoegel/pine/pkg/tree"
@@ -18,6 +24,10 @@ type TreeKeeper interface {
 	GetTreeStatus(ctx context.Context, name string) (*tree.Status, error)
 	ListTrees(ctx context.Context) ([]*tree.Status, error)
 	RotateTreeLog(ctx context.Context, name string) error
+	EnableTree(ctx context.Context, name string) error
+	DisableTree(ctx context.Context, name string) error
+	TreeLogs(ctx context.Context, name string, opts tree.LogOptions) (io.ReadCloser, error)
+	GetTreeOutput(ctx context.Context, name string) ([]string, error)
 }
 
 type HttpServer struct {
@@ -40,7 +50,11 @@ func (s *HttpServer) Start(ctx context.Context, ln net.Listener) error {
 	mux.HandleFunc("POST /tree/stop/{treeName}", s.stopTree(ctx))
 	mux.HandleFunc("POST /tree/restart/{treeName}", s.restartTree(ctx))
 	mux.HandleFunc("POST /tree/logrotate/{treeName}", s.rotateTreeLog(ctx))
+	mux.HandleFunc("POST /tree/enable/{treeName}", s.enableTree(ctx))
+	mux.HandleFunc("POST /tree/disable/{treeName}", s.disableTree(ctx))
 	mux.HandleFunc("GET /tree/{treeName}", s.treeStatus(ctx))
+	mux.HandleFunc("GET /tree/{treeName}/logs", s.treeLogs(ctx))
+	mux.HandleFunc("GET /tree/{treeName}/output", s.treeOutput(ctx))
 	mux.HandleFunc("GET /tree", s.listTrees(ctx))
 	s.server.Handler = mux
 
@@ -99,12 +113,7 @@ func (s *HttpServer) treeStatus(ctx context.Context) http.HandlerFunc {
 			w.WriteHeader(http.StatusNotFound)
 			return
 		}
-		resp := api.TreeStatusResponse{
-			TreeName:   name,
-			State:      string(status.State),
-			LastChange: uint64(status.LastChange.Unix()),
-			Uptime:     uint64(status.Uptime.Seconds()),
-		}
+		resp := newTreeStatusResponse(status)
 		w.Header().Add("content-type", "application/json")
 		encoder := json.NewEncoder(w)
 		if err := encoder.Encode(resp); err != nil {
@@ -114,6 +123,101 @@ func (s *HttpServer) treeStatus(ctx context.Context) http.HandlerFunc {
 	}
 }
 
+func (s *HttpServer) treeOutput(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("treeName")
+		lines, err := s.keeper.GetTreeOutput(ctx, name)
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp := &api.TreeOutputResponse{
+			TreeName: name,
+			Lines:    lines,
+		}
+		w.Header().Add("content-type", "application/json")
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(resp); err != nil {
+			slog.Error("could not encode tree output api response", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}
+}
+
+func (s *HttpServer) treeLogs(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("treeName")
+		opts, err := parseLogOptions(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// following ends when either the client goes away or pine shuts down
+		logCtx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		defer context.AfterFunc(ctx, cancel)()
+
+		logs, err := s.keeper.TreeLogs(logCtx, name, opts)
+		if errors.Is(err, ErrTreeNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			slog.Warn("failed to read tree logs", "name", name, "err", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer logs.Close()
+
+		w.Header().Add("content-type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		flusher, _ := w.(http.Flusher)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := logs.Read(buf)
+			if n > 0 {
+				if _, err := w.Write(buf[:n]); err != nil {
+					return
+				}
+				if opts.Follow && flusher != nil {
+					flusher.Flush()
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				return
+			} else if err != nil {
+				slog.Warn("stopped streaming tree logs", "name", name, "err", err)
+				return
+			}
+		}
+	}
+}
+
+// parseLogOptions reads the lines, since and follow query parameters. Since is
+// either a RFC 3339 time or a duration before now.
+func parseLogOptions(query url.Values) (tree.LogOptions, error) {
+	opts := tree.LogOptions{}
+	var err error
+	if value := query.Get("lines"); len(value) > 0 {
+		if opts.Lines, err = strconv.Atoi(value); err != nil || opts.Lines < 0 {
+			return opts, fmt.Errorf("invalid lines '%s'", value)
+		}
+	}
+	if value := query.Get("since"); len(value) > 0 {
+		if ago, err := time.ParseDuration(value); err == nil {
+			opts.Since = time.Now().Add(-ago)
+		} else if opts.Since, err = time.Parse(time.RFC3339Nano, value); err != nil {
+			return opts, fmt.Errorf("invalid since '%s'", value)
+		}
+	}
+	if value := query.Get("follow"); len(value) > 0 {
+		if opts.Follow, err = strconv.ParseBool(value); err != nil {
+			return opts, fmt.Errorf("invalid follow '%s'", value)
+		}
+	}
+	return opts, nil
+}
+
 func (s *HttpServer) listTrees(ctx context.Context) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		statusList, err := s.keeper.ListTrees(ctx)
@@ -124,12 +228,7 @@ func (s *HttpServer) listTrees(ctx context.Context) http.HandlerFunc {
 			Trees: []api.TreeStatusResponse{},
 		}
 		for _, status := range statusList {
-			resp.Trees = append(resp.Trees, api.TreeStatusResponse{
-				TreeName:   status.For.Name,
-				State:      string(status.State),
-				LastChange: uint64(status.LastChange.Unix()),
-				Uptime:     uint64(status.Uptime.Seconds()),
-			})
+			resp.Trees = append(resp.Trees, newTreeStatusResponse(status))
 		}
 		w.Header().Add("content-type", "application/json")
 		encoder := json.NewEncoder(w)
@@ -150,3 +249,63 @@ func (s *HttpServer) rotateTreeLog(ctx context.Context) http.HandlerFunc {
 		}
 	}
 }
+
+func (s *HttpServer) enableTree(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("treeName")
+		if s.keeper.EnableTree(ctx, name) != nil {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+func (s *HttpServer) disableTree(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("treeName")
+		if s.keeper.DisableTree(ctx, name) != nil {
+			w.WriteHeader(http.StatusNotFound)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+}
+
+func newTreeStatusResponse(status *tree.Status) api.TreeStatusResponse {
+	resp := api.TreeStatusResponse{
+		TreeName:   status.For.Name,
+		State:      string(status.State),
+		StatusText: status.StatusText,
+		LastChange: uint64(status.LastChange.Unix()),
+		Uptime:     uint64(status.Uptime.Seconds()),
+		Pid:        status.Pid,
+		RunCount:   status.RunCount,
+		ExitCode:   status.ExitCode,
+		ExitSignal: status.ExitSignal,
+		ExitReason: string(status.ExitReason),
+		Health:     string(status.Health),
+		LastError:  status.LastError,
+		LastOutput: status.LastOutput,
+		Enabled:    status.Enabled,
+
+		Cgroup:        status.Cgroup,
+		MemoryCurrent: status.Usage.MemoryCurrent,
+		MemoryPeak:    status.Usage.MemoryPeak,
+		CPUUsageUsec:  uint64(status.Usage.CPUUsage.Microseconds()),
+		OOMKills:      status.Usage.OOMKills,
+	}
+	for _, limit := range status.Limits {
+		resp.Limits = append(resp.Limits, limit.Resource+"="+limit.String())
+	}
+	if !status.NextRestart.IsZero() {
+		resp.NextRestart = uint64(status.NextRestart.Unix())
+	}
+	if !status.NextRun.IsZero() {
+		resp.NextRun = uint64(status.NextRun.Unix())
+	}
+	if !status.LastRun.IsZero() {
+		resp.LastRun = uint64(status.LastRun.Unix())
+	}
+	return resp
+}
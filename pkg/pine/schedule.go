@@ -0,0 +1,160 @@
+package pine
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+// treeSchedule tracks the runs of a tree started on its schedule.
+type treeSchedule struct {
+	cancel  context.CancelFunc
+	nextRun time.Time
+	lastRun time.Time
+}
+
+// scheduleTree starts running name on its schedule, replacing any schedule it
+// already had, unless the tree is disabled. It returns false if the tree has
+// no schedule.
+func (d *Daemon) scheduleTree(ctx context.Context, name string) bool {
+	d.unscheduleTree(name)
+
+	d.treeLock.RLock()
+	t, ok := d.trees[name]
+	d.treeLock.RUnlock()
+	if !ok {
+		return false
+	}
+	cfg := t.Config()
+	if len(cfg.Schedule.Expr) == 0 {
+		return false
+	} else if !d.isEnabled(cfg) {
+		slog.Info("not scheduling disabled tree", "name", name)
+		return true
+	}
+
+	schedCtx, cancel := context.WithCancel(ctx)
+	sched := &treeSchedule{
+		cancel:  cancel,
+		lastRun: d.readStamp(name),
+	}
+	d.scheduleLock.Lock()
+	d.schedules[name] = sched
+	d.scheduleLock.Unlock()
+
+	slog.Info("scheduling tree", "name", name, "schedule", cfg.Schedule.Expr)
+	d.wg.Go(func() {
+		d.runSchedule(ctx, schedCtx, cfg, sched)
+	})
+	return true
+}
+
+func (d *Daemon) unscheduleTree(name string) {
+	d.scheduleLock.Lock()
+	defer d.scheduleLock.Unlock()
+	if sched, ok := d.schedules[name]; ok {
+		sched.cancel()
+		delete(d.schedules, name)
+	}
+}
+
+// runSchedule starts the tree each time its schedule elapses until schedCtx
+// is done. Persistent trees first catch up on a run missed while pine was
+// down. The runs themselves use the daemon's ctx so that rescheduling a tree
+// does not stop it.
+func (d *Daemon) runSchedule(ctx context.Context, schedCtx context.Context, cfg tree.Config, sched *treeSchedule) {
+	d.scheduleLock.Lock()
+	lastRun := sched.lastRun
+	d.scheduleLock.Unlock()
+	if cfg.Persistent && !lastRun.IsZero() && !cfg.Schedule.Next(lastRun).After(time.Now()) {
+		slog.Info("catching up on missed scheduled run", "name", cfg.Name, "lastRun", lastRun)
+		d.runScheduled(ctx, cfg.Name, sched)
+	}
+
+	for {
+		next := cfg.Schedule.Next(time.Now())
+		if next.IsZero() {
+			slog.Warn("tree schedule has no upcoming runs", "name", cfg.Name, "schedule", cfg.Schedule.Expr)
+			return
+		}
+		d.scheduleLock.Lock()
+		sched.nextRun = next
+		d.scheduleLock.Unlock()
+
+		timer := timerUntil(next)
+		select {
+		case <-schedCtx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		d.runScheduled(ctx, cfg.Name, sched)
+	}
+}
+
+// runScheduled starts a scheduled run unless the previous one is still active.
+func (d *Daemon) runScheduled(ctx context.Context, name string, sched *treeSchedule) {
+	if d.isRunning(name) {
+		slog.Warn("skipping scheduled run, previous run is still active", "name", name)
+		return
+	}
+
+	now := time.Now()
+	d.scheduleLock.Lock()
+	sched.lastRun = now
+	d.scheduleLock.Unlock()
+	if err := d.writeStamp(name, now); err != nil {
+		slog.Warn("failed to record scheduled run", "name", name, "err", err)
+	}
+
+	slog.Info("starting scheduled run", "name", name)
+	if err := d.StartTree(ctx, name); err != nil {
+		slog.Warn("failed to start scheduled run", "name", name, "err", err)
+	}
+}
+
+// scheduleStatus adds the next and last scheduled runs to status.
+func (d *Daemon) scheduleStatus(status *tree.Status) {
+	d.scheduleLock.Lock()
+	defer d.scheduleLock.Unlock()
+	if sched, ok := d.schedules[status.For.Name]; ok {
+		status.NextRun = sched.nextRun
+		status.LastRun = sched.lastRun
+	}
+}
+
+func (d *Daemon) stampFile(name string) string {
+	return filepath.Join(d.config.StateDir, "schedules", name+".stamp")
+}
+
+// readStamp returns when name last ran on its schedule, or the zero time if
+// it never did.
+func (d *Daemon) readStamp(name string) time.Time {
+	data, err := os.ReadFile(d.stampFile(name))
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to read schedule stamp", "name", name, "err", err)
+		}
+		return time.Time{}
+	}
+	lastRun, err := time.Parse(time.RFC3339, strings.TrimSpace(string(data)))
+	if err != nil {
+		slog.Warn("invalid schedule stamp", "name", name, "err", err)
+		return time.Time{}
+	}
+	return lastRun
+}
+
+func (d *Daemon) writeStamp(name string, lastRun time.Time) error {
+	filename := d.stampFile(name)
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, []byte(lastRun.Format(time.RFC3339)+"\n"), 0644)
+}
@@ -0,0 +1,49 @@
+package pine_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduledTree(t *testing.T) {
+	tmpDir := t.TempDir()
+	runs := filepath.Join(tmpDir, "runs")
+	// runs every second but takes longer than that, so every other run overlaps
+	writeTree(t, tmpDir, "backup", "Type oneshot\nSchedule *:*:*\nCommand sh -c 'echo run >> "+runs+"; sleep 1.5'\n")
+	daemon := runDaemon(t, tmpDir)
+
+	time.Sleep(3500 * time.Millisecond)
+	data, err := os.ReadFile(runs)
+	noErr(t, err)
+	if count := strings.Count(string(data), "run"); count < 1 || count > 2 {
+		t.Errorf("unexpected number of runs: %d", count)
+	}
+
+	status, err := daemon.GetTreeStatus(context.Background(), "backup")
+	noErr(t, err)
+	if status.LastRun.IsZero() || !status.NextRun.After(status.LastRun) {
+		t.Errorf("unexpected run times: next=%s last=%s", status.NextRun, status.LastRun)
+	}
+}
+
+func TestScheduledTreePersistent(t *testing.T) {
+	tmpDir := t.TempDir()
+	marker := filepath.Join(tmpDir, "ran")
+	writeTree(t, tmpDir, "cleanup", "Type oneshot\nSchedule daily\nPersistent yes\nCommand touch "+marker+"\n")
+
+	// the last run was two days ago, so one was missed while pine was down
+	stamp := filepath.Join(tmpDir, "schedules", "cleanup.stamp")
+	noErr(t, os.MkdirAll(filepath.Dir(stamp), 0755))
+	lastRun := time.Now().Add(-48 * time.Hour).Format(time.RFC3339)
+	noErr(t, os.WriteFile(stamp, []byte(lastRun+"\n"), 0644))
+
+	runDaemon(t, tmpDir)
+	time.Sleep(500 * time.Millisecond)
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("missed run was not caught up: %v", err)
+	}
+}
@@ -0,0 +1,178 @@
+package pine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+const stateSaveInterval = time.Second
+
+// daemonState is what pine remembers about its trees across restarts.
+type daemonState struct {
+	// BootID tells whether the processes in the state can still be running.
+	BootID string                    `json:"bootId"`
+	Trees  map[string]savedTreeState `json:"trees"`
+}
+
+type savedTreeState struct {
+	Pid       int       `json:"pid,omitempty"`
+	StartTime uint64    `json:"startTime,omitempty"`
+	StartedAt time.Time `json:"startedAt,omitzero"`
+	RunCount  int       `json:"runCount"`
+	Stopped   bool      `json:"stopped,omitempty"` // stopped manually
+	Enabled   *bool     `json:"enabled,omitempty"` // enabled or disabled manually
+}
+
+func (d *Daemon) stateFile() string {
+	return filepath.Join(d.config.StateDir, "state.json")
+}
+
+// loadState reads the state left by the previous pine. A missing or invalid
+// state file means starting from scratch.
+func (d *Daemon) loadState() daemonState {
+	state := daemonState{Trees: map[string]savedTreeState{}}
+	data, err := os.ReadFile(d.stateFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return state
+	} else if err == nil {
+		err = json.Unmarshal(data, &state)
+	}
+	if err != nil {
+		slog.Warn("ignoring invalid state file", "filename", d.stateFile(), "err", err)
+		return daemonState{Trees: map[string]savedTreeState{}}
+	}
+	if state.Trees == nil {
+		state.Trees = map[string]savedTreeState{}
+	}
+	return state
+}
+
+// adoption returns the process of name that is still running from before pine
+// restarted, if any.
+func (s daemonState) adoption(name string) (tree.Adoption, bool) {
+	saved, ok := s.Trees[name]
+	if !ok || saved.Pid == 0 || s.BootID != bootID() {
+		return tree.Adoption{}, false
+	}
+	return tree.Adoption{
+		Pid:       saved.Pid,
+		StartTime: saved.StartTime,
+		StartedAt: saved.StartedAt,
+		RunCount:  saved.RunCount,
+	}, true
+}
+
+// adoptTree takes over the process of name left running by the previous pine.
+// It returns false if there is none and the tree has to be started normally.
+func (d *Daemon) adoptTree(ctx context.Context, name string, state daemonState) bool {
+	adoption, ok := state.adoption(name)
+	if !ok {
+		return false
+	}
+	d.treeLock.RLock()
+	t, ok := d.trees[name]
+	d.treeLock.RUnlock()
+	if !ok {
+		return false
+	}
+	if err := t.Adopt(adoption); err != nil {
+		slog.Info("not adopting tree", "name", name, "err", err)
+		return false
+	}
+	if err := d.StartTree(ctx, name); err != nil {
+		slog.Warn("failed to start adopted tree", "name", name, "err", err)
+	}
+	return true
+}
+
+// currentState captures the running processes, manual stops, and enabled
+// overrides of all trees.
+func (d *Daemon) currentState(ctx context.Context) daemonState {
+	state := daemonState{
+		BootID: bootID(),
+		Trees:  map[string]savedTreeState{},
+	}
+	statuses, _ := d.ListTrees(ctx)
+	d.runLock.Lock()
+	defer d.runLock.Unlock()
+	for _, status := range statuses {
+		name := status.For.Name
+		saved := savedTreeState{
+			RunCount: status.RunCount,
+			Stopped:  d.manualStops[name],
+		}
+		if enabled, ok := d.enabled[name]; ok {
+			saved.Enabled = &enabled
+		}
+		if status.Pid != 0 {
+			if startTime, err := tree.ProcessStartTime(status.Pid); err == nil {
+				saved.Pid = status.Pid
+				saved.StartTime = startTime
+				saved.StartedAt = time.Now().Add(-status.Uptime).Truncate(time.Second)
+			}
+		}
+		state.Trees[name] = saved
+	}
+	return state
+}
+
+// persistState saves the state whenever it changes until ctx is done.
+func (d *Daemon) persistState(ctx context.Context) {
+	ticker := time.NewTicker(stateSaveInterval)
+	defer ticker.Stop()
+	var last []byte
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		data, err := json.Marshal(d.currentState(ctx))
+		if err != nil || bytes.Equal(data, last) {
+			continue
+		}
+		if err := d.writeState(data); err != nil {
+			slog.Warn("failed to save state", "err", err)
+			continue
+		}
+		last = data
+	}
+}
+
+func (d *Daemon) saveState(ctx context.Context) error {
+	data, err := json.Marshal(d.currentState(ctx))
+	if err != nil {
+		return err
+	}
+	return d.writeState(data)
+}
+
+// writeState replaces the state file atomically, so a crash never leaves a
+// partial state behind.
+func (d *Daemon) writeState(data []byte) error {
+	if err := os.MkdirAll(d.config.StateDir, 0755); err != nil {
+		return err
+	}
+	tmpFile := d.stateFile() + ".tmp"
+	if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, d.stateFile())
+}
+
+func bootID() string {
+	data, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,219 @@
+package pine_test
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	pine "github.com/mpoegel/pine/pkg/pine"
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+// startOrphan starts a process and the holder of its output the way pine
+// starts a tree, as if it was left running by a pine that crashed.
+func startOrphan(t *testing.T, command string) *exec.Cmd {
+	outReader, outWriter, err := os.Pipe()
+	noErr(t, err)
+	errReader, errWriter, err := os.Pipe()
+	noErr(t, err)
+	cmd := exec.Command("sh", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Stdout = outWriter
+	cmd.Stderr = errWriter
+	noErr(t, cmd.Start())
+	outWriter.Close()
+	errWriter.Close()
+
+	startTime, err := tree.ProcessStartTime(cmd.Process.Pid)
+	noErr(t, err)
+	holder := &exec.Cmd{
+		Path:       os.Args[0],
+		Args:       []string{"pine-output", strconv.Itoa(cmd.Process.Pid), strconv.FormatUint(startTime, 10)},
+		Env:        []string{"_PINE_OUTPUT_HOLDER=1"},
+		ExtraFiles: []*os.File{outReader, errReader},
+	}
+	noErr(t, holder.Start())
+	go holder.Wait()
+	outReader.Close()
+	errReader.Close()
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	t.Cleanup(func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-exited
+	})
+	return cmd
+}
+
+func writeState(t *testing.T, dir string, state map[string]any) {
+	bootID, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	noErr(t, err)
+	data, err := json.Marshal(map[string]any{
+		"bootId": strings.TrimSpace(string(bootID)),
+		"trees":  state,
+	})
+	noErr(t, err)
+	noErr(t, os.WriteFile(filepath.Join(dir, "state.json"), data, 0644))
+}
+
+func TestAdoptRunningTree(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTree(t, tmpDir, "worker", "Command sleep 30\n")
+	orphan := startOrphan(t, "while true; do echo tick; sleep 0.1; done")
+	pid := orphan.Process.Pid
+	startTime, err := tree.ProcessStartTime(pid)
+	noErr(t, err)
+	writeState(t, tmpDir, map[string]any{
+		"worker": map[string]any{
+			"pid":       pid,
+			"startTime": startTime,
+			"startedAt": time.Now().Add(-time.Hour),
+			"runCount":  3,
+		},
+	})
+
+	daemon := runDaemon(t, tmpDir)
+	time.Sleep(500 * time.Millisecond)
+
+	status, err := daemon.GetTreeStatus(context.Background(), "worker")
+	noErr(t, err)
+	if status.State != tree.RunningState || status.Pid != pid || status.RunCount != 3 {
+		t.Fatalf("tree was not adopted: state=%s pid=%d runs=%d", status.State, status.Pid, status.RunCount)
+	}
+	if status.Uptime < time.Hour {
+		t.Errorf("uptime was not restored: %s", status.Uptime)
+	}
+	logs, err := os.ReadFile(filepath.Join(tmpDir, "worker.log"))
+	noErr(t, err)
+	if !strings.Contains(string(logs), "tick") {
+		t.Error("output of adopted tree was not captured")
+	}
+
+	noErr(t, daemon.StopTree(context.Background(), "worker"))
+	time.Sleep(500 * time.Millisecond)
+	if state := treeState(t, daemon, "worker"); state != tree.StoppedState {
+		t.Errorf("adopted tree did not stop: %s", state)
+	}
+}
+
+func TestAdoptAfterCrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTree(t, tmpDir, "worker", "Command sleep 30\n")
+	orphan := startOrphan(t, "sleep 30")
+	pid := orphan.Process.Pid
+	startTime, err := tree.ProcessStartTime(pid)
+	noErr(t, err)
+	writeState(t, tmpDir, map[string]any{
+		"worker": map[string]any{"pid": pid, "startTime": startTime},
+	})
+	// a pine that crashed leaves its socket behind
+	ln, err := net.Listen("unix", filepath.Join(tmpDir, "pine.sock"))
+	noErr(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	daemon := runDaemon(t, tmpDir)
+	time.Sleep(500 * time.Millisecond)
+
+	status, err := daemon.GetTreeStatus(context.Background(), "worker")
+	noErr(t, err)
+	if status.State != tree.RunningState || status.Pid != pid {
+		t.Fatalf("tree was not adopted: state=%s pid=%d", status.State, status.Pid)
+	}
+
+	// while the daemon runs, its socket is not taken over
+	other := pine.NewDaemon(pine.Config{
+		TreeDir:          tmpDir,
+		UdsEndpoint:      filepath.Join(tmpDir, "pine.sock"),
+		StateDir:         tmpDir,
+		UnprivilegedMode: true,
+	})
+	if err := other.Run(context.Background()); err == nil {
+		t.Error("expected a second daemon on the same socket to fail")
+	}
+}
+
+func TestAdoptReusedPid(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTree(t, tmpDir, "worker", "Command sleep 30\n")
+	orphan := startOrphan(t, "sleep 30")
+	pid := orphan.Process.Pid
+	startTime, err := tree.ProcessStartTime(pid)
+	noErr(t, err)
+	writeState(t, tmpDir, map[string]any{
+		"worker": map[string]any{"pid": pid, "startTime": startTime + 1},
+	})
+
+	daemon := runDaemon(t, tmpDir)
+	time.Sleep(500 * time.Millisecond)
+
+	status, err := daemon.GetTreeStatus(context.Background(), "worker")
+	noErr(t, err)
+	if status.State != tree.RunningState || status.Pid == pid || status.Pid == 0 {
+		t.Errorf("expected a new process: state=%s pid=%d", status.State, status.Pid)
+	}
+}
+
+func TestManualStopPersists(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTree(t, tmpDir, "worker", "Command sleep 30\n")
+	writeTree(t, tmpDir, "other", "Command sleep 30\n")
+
+	daemon, stop := startDaemon(tmpDir)
+	time.Sleep(300 * time.Millisecond)
+	noErr(t, daemon.StopTree(context.Background(), "worker"))
+	time.Sleep(300 * time.Millisecond)
+	stop()
+
+	daemon = runDaemon(t, tmpDir)
+	time.Sleep(500 * time.Millisecond)
+	if state := treeState(t, daemon, "worker"); state != tree.StoppedState {
+		t.Errorf("manually stopped tree was started: %s", state)
+	}
+	if state := treeState(t, daemon, "other"); state != tree.RunningState {
+		t.Errorf("tree was not started: %s", state)
+	}
+}
+
+func TestEnabledPersists(t *testing.T) {
+	tmpDir := t.TempDir()
+	writeTree(t, tmpDir, "manual", "Command sleep 30\nAutoStart no\n")
+	writeTree(t, tmpDir, "worker", "Command sleep 30\n")
+
+	daemon, stop := startDaemon(tmpDir)
+	time.Sleep(300 * time.Millisecond)
+	if state := treeState(t, daemon, "manual"); state != tree.StoppedState {
+		t.Errorf("tree without auto start was started: %s", state)
+	}
+	noErr(t, daemon.EnableTree(context.Background(), "manual"))
+	noErr(t, daemon.DisableTree(context.Background(), "worker"))
+	if state := treeState(t, daemon, "worker"); state != tree.RunningState {
+		t.Errorf("disabling stopped the tree: %s", state)
+	}
+	stop()
+
+	daemon = runDaemon(t, tmpDir)
+	time.Sleep(500 * time.Millisecond)
+	manual, err := daemon.GetTreeStatus(context.Background(), "manual")
+	noErr(t, err)
+	if manual.State != tree.RunningState || !manual.Enabled {
+		t.Errorf("enabled tree was not started: state=%s enabled=%t", manual.State, manual.Enabled)
+	}
+	worker, err := daemon.GetTreeStatus(context.Background(), "worker")
+	noErr(t, err)
+	if worker.State != tree.StoppedState || worker.Enabled {
+		t.Errorf("disabled tree was started: state=%s enabled=%t", worker.State, worker.Enabled)
+	}
+}
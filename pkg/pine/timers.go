@@ -17,5 +17,9 @@ func timerUntilMidnight() *time.Timer {
 		loc,
 	)
 
-	return time.NewTimer(time.Until(nextMidnight))
+	return timerUntil(nextMidnight)
+}
+
+func timerUntil(t time.Time) *time.Timer {
+	return time.NewTimer(time.Until(t))
 }
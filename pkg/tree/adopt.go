@@ -0,0 +1,116 @@
+package tree
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"syscall"
+	"time"
+)
+
+// Adoption describes a tree process left running by a previous pine.
+type Adoption struct {
+	Pid       int
+	StartTime uint64 // from ProcessStartTime
+	StartedAt time.Time
+	RunCount  int
+}
+
+// verify checks that the process is still running and the pid was not reused.
+func (a Adoption) verify() error {
+	startTime, err := ProcessStartTime(a.Pid)
+	if err != nil {
+		return fmt.Errorf("process %d is gone: %w", a.Pid, err)
+	}
+	if startTime != a.StartTime {
+		return fmt.Errorf("process %d was replaced by another process", a.Pid)
+	}
+	return nil
+}
+
+// Adopt makes the next Start take over a process left running by a previous
+// pine instead of spawning a new one.
+func (t *TreeImpl) Adopt(a Adoption) error {
+	if err := a.verify(); err != nil {
+		return err
+	}
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	t.adoption = &a
+	return nil
+}
+
+func (t *TreeImpl) adopt(cfg Config, a Adoption) (*process, error) {
+	if err := a.verify(); err != nil {
+		return nil, err
+	}
+	pgid := processGroup(a.Pid)
+	if pgid == 0 {
+		return nil, fmt.Errorf("process %d is gone", a.Pid)
+	} else if pgid == syscall.Getpgrp() {
+		// stopping the tree would signal pine's own process group
+		return nil, fmt.Errorf("process %d is in pine's process group", a.Pid)
+	}
+
+	envVars, err := t.environment(cfg)
+	if err != nil {
+		return nil, err
+	}
+	proc := &process{
+		pid:        a.Pid,
+		pgid:       pgid,
+		cgroup:     adoptedCgroup(cfg, a.Pid),
+		env:        envVars,
+		ready:      make(chan struct{}),
+		watchdog:   make(chan struct{}, 1),
+		outputDone: make(chan struct{}),
+	}
+	if cfg.Type == NotifyType || cfg.WatchdogSec > 0 {
+		var err error
+		if proc.notify, err = listenNotify(cfg.Name); err != nil {
+			return nil, fmt.Errorf("failed to create notify socket: %w", err)
+		}
+	}
+
+	var out *runOutput
+	var pipes []*os.File
+	holder, err := findHolder(a.Pid, a.StartTime)
+	if err == nil {
+		pipes, err = reopenOutput(holder)
+	}
+	if err != nil {
+		slog.Warn("cannot capture output of adopted tree", "name", cfg.Name, "pid", a.Pid, "err", err)
+		close(proc.outputDone)
+	} else {
+		out = t.openOutput(cfg)
+		t.outputMu.Lock()
+		proc.outputMark = t.output.added
+		t.outputMu.Unlock()
+		out.setProcess(a.Pid, a.RunCount)
+		go t.copyOutput(pipes, out, proc.outputDone)
+	}
+
+	slog.Info("adopted tree", "name", cfg.Name, "pid", a.Pid)
+	t.stateMu.Lock()
+	t.runOutput = out
+	t.pid = proc.pid
+	t.pgid = proc.pgid
+	t.cgroup = proc.cgroup
+	t.runCount = a.RunCount
+	t.statusText = ""
+	t.startedAt = a.StartedAt
+	if cfg.Type == OneshotType {
+		t.setState(StartingState)
+	} else {
+		t.setState(RunningState)
+		proc.markReady()
+	}
+	t.stateMu.Unlock()
+
+	if proc.notify != nil {
+		go proc.notify.serve(func(pid int, fields map[string]string) {
+			t.handleNotify(proc, cfg, pid, fields)
+		})
+	}
+	return proc, nil
+}
@@ -0,0 +1,130 @@
+package tree
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// maxOutputLineLength bounds the lines kept by an outputBuffer, longer
+	// lines are split.
+	maxOutputLineLength = 4096
+	// outputTailLines is how many lines of output the status and the error of
+	// a failed run include.
+	outputTailLines = 5
+	// outputDrainTimeout is how long to wait for the output of a process that
+	// exited to arrive.
+	outputDrainTimeout = 100 * time.Millisecond
+)
+
+// outputBuffer keeps the last lines of the output of a tree in memory, so they
+// are available even when the log file is not.
+type outputBuffer struct {
+	lines   []string // ring of complete lines
+	next    int
+	full    bool
+	partial []byte
+	added   int // complete lines ever added
+}
+
+func newOutputBuffer(size int) *outputBuffer {
+	return &outputBuffer{lines: make([]string, size)}
+}
+
+func (b *outputBuffer) Write(p []byte) {
+	if len(b.lines) == 0 {
+		return
+	}
+	for len(p) > 0 {
+		line, rest, complete := bytes.Cut(p, []byte{'\n'})
+		b.partial = append(b.partial, line...)
+		for len(b.partial) > maxOutputLineLength {
+			b.add(string(b.partial[:maxOutputLineLength]))
+			b.partial = b.partial[maxOutputLineLength:]
+		}
+		if complete {
+			b.add(string(b.partial))
+			b.partial = b.partial[:0]
+		}
+		p = rest
+	}
+}
+
+func (b *outputBuffer) add(line string) {
+	b.lines[b.next] = line
+	b.added++
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Lines returns up to the last n lines, including a partial line, or as many
+// lines as the buffer holds if n is 0.
+func (b *outputBuffer) Lines(n int) []string {
+	if n == 0 {
+		n = len(b.lines)
+	}
+	lines := b.completeLines()
+	if len(b.partial) > 0 {
+		lines = append(lines, string(b.partial))
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+func (b *outputBuffer) completeLines() []string {
+	lines := []string{}
+	if b.full {
+		lines = append(lines, b.lines[b.next:]...)
+	}
+	return append(lines, b.lines[:b.next]...)
+}
+
+// resize returns a buffer of size holding the last lines of b. It keeps the
+// count of lines added, which the marks of running processes refer to.
+func (b *outputBuffer) resize(size int) *outputBuffer {
+	resized := newOutputBuffer(size)
+	if size > 0 {
+		lines := b.completeLines()
+		for _, line := range lines[max(len(lines)-size, 0):] {
+			resized.add(line)
+		}
+		resized.partial = slices.Clone(b.partial)
+	}
+	resized.added = b.added
+	return resized
+}
+
+// linesSince returns up to the last n lines written since the buffer had added
+// mark lines.
+func (b *outputBuffer) linesSince(mark int, n int) []string {
+	since := b.added - mark
+	if len(b.partial) > 0 {
+		since++
+	}
+	since = min(max(since, 0), n)
+	if since == 0 {
+		return nil
+	}
+	return b.Lines(since)
+}
+
+// outputError adds the last output of a run to the error it failed with.
+type outputError struct {
+	err    error
+	output []string
+}
+
+func (e *outputError) Error() string {
+	return fmt.Sprintf("%s, last output: %s", e.err, strings.Join(e.output, " / "))
+}
+
+func (e *outputError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,415 @@
+package tree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	CgroupRoot = "/sys/fs/cgroup"
+	// CgroupParent is the cgroup to create pine.slice in, pine's own delegated
+	// cgroup if empty.
+	CgroupParent = ""
+	// CloneIntoCgroup starts trees right in their cgroups with clone3. Without
+	// it, or where the kernel does not support it, the exec helper moves itself
+	// into the tree's cgroup before executing the tree's command.
+	CloneIntoCgroup = true
+)
+
+const (
+	sliceCgroup      = "pine.slice"
+	supervisorCgroup = "supervisor" // pine's own leaf in a delegated cgroup
+	cpuPeriod        = 100000       // microseconds, the default period of cpu.max
+	defaultWeight    = 100
+	// cgroupDrainTimeout is how long killed processes get to leave their
+	// cgroup before it is removed
+	cgroupDrainTimeout = time.Second
+)
+
+// cgroupControllers are enabled for the trees' cgroups where they are available.
+var cgroupControllers = []string{"cpu", "io", "memory", "pids"}
+
+// ResourceUsage is the accounting of a tree's cgroup. Values whose controller
+// is not available are zero.
+type ResourceUsage struct {
+	MemoryCurrent uint64 // bytes
+	MemoryPeak    uint64 // bytes
+	CPUUsage      time.Duration
+	OOMKills      uint64
+}
+
+var cgroupSetup struct {
+	mu     sync.Mutex
+	done   bool
+	root   string
+	parent string
+	slice  string
+	err    error
+	// noClone is set once starting a process in a cgroup failed
+	noClone bool
+}
+
+// treeSlice returns the cgroup that holds the cgroups of the trees, setting it
+// up the first time. It fails if pine has no cgroup v2 hierarchy of its own,
+// in which case trees run without cgroups.
+func treeSlice() (string, error) {
+	cgroupSetup.mu.Lock()
+	defer cgroupSetup.mu.Unlock()
+	if !cgroupSetup.done || cgroupSetup.root != CgroupRoot || cgroupSetup.parent != CgroupParent {
+		cgroupSetup.done = true
+		cgroupSetup.root = CgroupRoot
+		cgroupSetup.parent = CgroupParent
+		cgroupSetup.slice, cgroupSetup.err = setupCgroups(CgroupRoot, CgroupParent)
+		if cgroupSetup.err != nil {
+			slog.Info("cgroups are unavailable, trees run without them", "err", cgroupSetup.err)
+		} else {
+			slog.Debug("trees run in cgroups", "slice", cgroupSetup.slice)
+		}
+	}
+	return cgroupSetup.slice, cgroupSetup.err
+}
+
+// cloneIntoCgroup reports whether trees are started right in their cgroups.
+func cloneIntoCgroup() bool {
+	cgroupSetup.mu.Lock()
+	defer cgroupSetup.mu.Unlock()
+	return CloneIntoCgroup && !cgroupSetup.noClone
+}
+
+// cloneUnsupported reports whether starting a process failed because it could
+// not be started in a cgroup, as with kernels before 5.7 or seccomp filters
+// that reject clone3. Trees are not started in their cgroups from then on.
+func cloneUnsupported(err error) bool {
+	if !errors.Is(err, syscall.ENOSYS) && !errors.Is(err, syscall.EINVAL) {
+		return false
+	}
+	cgroupSetup.mu.Lock()
+	defer cgroupSetup.mu.Unlock()
+	if !cgroupSetup.noClone {
+		slog.Warn("cannot start trees in their cgroups, moving them in instead", "err", err)
+		cgroupSetup.noClone = true
+	}
+	return true
+}
+
+// setupCgroups creates pine.slice in parent, or in pine's delegated cgroup,
+// with the controllers of the trees enabled.
+func setupCgroups(root string, parent string) (string, error) {
+	base := parent
+	if len(base) == 0 {
+		var err error
+		if base, err = delegatedCgroup(root); err != nil {
+			return "", err
+		}
+	} else if err := checkCgroup2(base); err != nil {
+		return "", err
+	}
+
+	enableControllers(base)
+	slice := filepath.Join(base, sliceCgroup)
+	if err := os.Mkdir(slice, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", err
+	}
+	enableControllers(slice)
+	return slice, nil
+}
+
+// delegatedCgroup returns the cgroup delegated to pine. Unless pine runs in
+// the root of the hierarchy, e.g. in a container, its cgroup must be delegated
+// to it. Since processes may only live in leaf cgroups once controllers are
+// enabled, pine moves itself into a leaf of its own, unless it already runs in
+// one as with systemd's DelegateSubgroup.
+func delegatedCgroup(root string) (string, error) {
+	if err := checkCgroup2(root); err != nil {
+		return "", err
+	}
+	own, err := processCgroupPath("self")
+	if err != nil {
+		return "", err
+	}
+	base := filepath.Join(root, own)
+	if own == "/" {
+		return base, nil
+	}
+	switch {
+	case delegated(base):
+		leaf := filepath.Join(base, supervisorCgroup)
+		if err := os.Mkdir(leaf, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+			return "", err
+		}
+		if err := writeCgroupFile(leaf, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			return "", fmt.Errorf("failed to move pine into %s: %w", leaf, err)
+		}
+		return base, nil
+	case delegated(filepath.Dir(base)):
+		return filepath.Dir(base), nil
+	}
+	return "", fmt.Errorf("cgroup %s is not delegated to pine", own)
+}
+
+func checkCgroup2(path string) error {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(path, &stat); err != nil {
+		return err
+	}
+	if stat.Type != unix.CGROUP2_SUPER_MAGIC {
+		return fmt.Errorf("%s is not a cgroup v2 hierarchy", path)
+	}
+	return nil
+}
+
+// delegated reports whether the cgroup at path was delegated, as systemd marks
+// it for units with Delegate=yes.
+func delegated(path string) bool {
+	buf := make([]byte, 8)
+	for _, attr := range []string{"trusted.delegate", "user.delegate"} {
+		if n, err := unix.Getxattr(path, attr, buf); err == nil && string(buf[:n]) == "1" {
+			return true
+		}
+	}
+	return false
+}
+
+// enableControllers enables the available controllers of cgroupControllers
+// for the children of the cgroup at path.
+func enableControllers(path string) {
+	data, err := os.ReadFile(filepath.Join(path, "cgroup.controllers"))
+	if err != nil {
+		slog.Warn("failed to read cgroup controllers", "cgroup", path, "err", err)
+		return
+	}
+	available := strings.Fields(string(data))
+	for _, controller := range cgroupControllers {
+		if !slices.Contains(available, controller) {
+			continue
+		}
+		if err := writeCgroupFile(path, "cgroup.subtree_control", "+"+controller); err != nil {
+			slog.Warn("failed to enable cgroup controller", "cgroup", path, "controller", controller, "err", err)
+		}
+	}
+}
+
+// processCgroupPath returns the cgroup v2 path of pid, relative to the root of
+// the hierarchy. The pid may also be "self".
+func processCgroupPath(pid string) (string, error) {
+	fp, err := os.Open(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("process %s is not in a cgroup v2 hierarchy", pid)
+}
+
+// cgroupName returns the tree name as the name of its cgroup. Other bytes than
+// letters, digits, '-', '_' and '@' are escaped as \xNN like systemd does, so
+// that different names never share a cgroup and, unlike the interface files
+// of a cgroup, the name never contains a dot.
+func cgroupName(name string) string {
+	if len(name) == 0 {
+		// not the slice itself
+		return `\x00`
+	}
+	var cg strings.Builder
+	for _, c := range []byte(name) {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '@' {
+			cg.WriteByte(c)
+		} else {
+			fmt.Fprintf(&cg, `\x%02x`, c)
+		}
+	}
+	return cg.String()
+}
+
+// treeCgroup creates the cgroup of the tree and applies its resource control.
+// Without cgroups it returns an empty path.
+func treeCgroup(cfg Config) (string, error) {
+	slice, err := treeSlice()
+	if err != nil {
+		if cfg.resourceControl() {
+			slog.Warn("ignoring resource control without cgroups", "name", cfg.Name)
+		}
+		return "", nil
+	}
+	path := filepath.Join(slice, cgroupName(cfg.Name))
+	if err := os.Mkdir(path, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+		return "", fmt.Errorf("failed to create cgroup: %w", err)
+	}
+	return path, applyResourceControl(path, cfg)
+}
+
+// adoptedCgroup returns the cgroup of the tree a previous pine started as pid,
+// or an empty path if it is not in one of pine's cgroups.
+func adoptedCgroup(cfg Config, pid int) string {
+	slice, err := treeSlice()
+	if err != nil {
+		return ""
+	}
+	rel, err := processCgroupPath(strconv.Itoa(pid))
+	if err != nil {
+		return ""
+	}
+	path := filepath.Join(CgroupRoot, rel)
+	if path != filepath.Join(slice, cgroupName(cfg.Name)) {
+		return ""
+	}
+	return path
+}
+
+// removeCgroup removes the cgroup at path once its processes exited, giving up
+// after timeout.
+func removeCgroup(path string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for cgroupPopulated(path) {
+		if time.Now().After(deadline) {
+			slog.Warn("not removing cgroup with processes left", "cgroup", path)
+			return
+		}
+		time.Sleep(groupPollInterval)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		slog.Warn("failed to remove cgroup", "cgroup", path, "err", err)
+	}
+}
+
+// applyResourceControl writes the resource control of cfg to the cgroup at
+// path. Resources the tree does not configure are reset to their defaults, in
+// case an earlier configuration set them.
+func applyResourceControl(path string, cfg Config) error {
+	for _, setting := range []struct {
+		file  string
+		value string
+		set   bool
+	}{
+		{"memory.max", cgroupMax(cfg.MemoryMax), cfg.MemoryMax > 0},
+		{"memory.high", cgroupMax(cfg.MemoryHigh), cfg.MemoryHigh > 0},
+		{"cpu.max", cpuMax(cfg.CPUQuota), cfg.CPUQuota > 0},
+		{"cpu.weight", strconv.Itoa(cgroupWeight(cfg.CPUWeight)), cfg.CPUWeight > 0},
+		{"io.weight", "default " + strconv.Itoa(cgroupWeight(cfg.IOWeight)), cfg.IOWeight > 0},
+		{"pids.max", cgroupMax(cfg.TasksMax), cfg.TasksMax > 0},
+	} {
+		err := writeCgroupFile(path, setting.file, setting.value)
+		if err == nil || !setting.set {
+			continue
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Warn("ignoring resource control without its cgroup controller", "name", cfg.Name, "file", setting.file)
+			continue
+		}
+		return fmt.Errorf("failed to set %s of cgroup: %w", setting.file, err)
+	}
+	return nil
+}
+
+func cgroupMax(value int64) string {
+	if value <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+// cpuMax returns the cpu.max of a quota in percent of one CPU.
+func cpuMax(quota int) string {
+	if quota <= 0 {
+		return fmt.Sprintf("max %d", cpuPeriod)
+	}
+	return fmt.Sprintf("%d %d", quota*cpuPeriod/100, cpuPeriod)
+}
+
+func cgroupWeight(weight int) int {
+	if weight <= 0 {
+		return defaultWeight
+	}
+	return weight
+}
+
+func writeCgroupFile(path string, file string, value string) error {
+	return os.WriteFile(filepath.Join(path, file), []byte(value), 0644)
+}
+
+// signalCgroup delivers sig to every process in the cgroup at path. SIGKILL
+// goes through cgroup.kill where available, which also reaches processes
+// forked in the meantime.
+func signalCgroup(path string, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		if err := writeCgroupFile(path, "cgroup.kill", "1"); !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	data, err := os.ReadFile(filepath.Join(path, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, field := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(field)
+		if err != nil {
+			continue
+		}
+		if err := syscall.Kill(pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
+
+// cgroupPopulated reports whether any live process remains in the cgroup at
+// path.
+func cgroupPopulated(path string) bool {
+	populated, err := readCgroupKey(path, "cgroup.events", "populated")
+	return err == nil && populated > 0
+}
+
+// cgroupUsage returns the accounting of the cgroup at path.
+func cgroupUsage(path string) ResourceUsage {
+	usage := ResourceUsage{}
+	usage.MemoryCurrent, _ = readCgroupValue(path, "memory.current")
+	usage.MemoryPeak, _ = readCgroupValue(path, "memory.peak")
+	usec, _ := readCgroupKey(path, "cpu.stat", "usage_usec")
+	usage.CPUUsage = time.Duration(usec) * time.Microsecond
+	usage.OOMKills, _ = readCgroupKey(path, "memory.events", "oom_kill")
+	return usage
+}
+
+// readCgroupValue reads a cgroup file holding a single number.
+func readCgroupValue(path string, file string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+}
+
+// readCgroupKey reads the number of key from a cgroup file of "key value"
+// lines.
+func readCgroupKey(path string, file string, key string) (uint64, error) {
+	data, err := os.ReadFile(filepath.Join(path, file))
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if value, ok := strings.CutPrefix(line, key+" "); ok {
+			return strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("no %s in %s", key, file)
+}
@@ -0,0 +1,130 @@
+package tree_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+// testCgroup creates a throwaway cgroup below the test's own cgroup for the
+// trees' cgroups, which is removed with everything in it after the test.
+func testCgroup(t *testing.T) string {
+	if os.Geteuid() != 0 {
+		t.Skip("creating cgroups requires root")
+	}
+	data, err := os.ReadFile("/proc/self/cgroup")
+	noErr(t, err)
+	own := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			own = path
+		}
+	}
+	for _, root := range []string{"/sys/fs/cgroup", "/sys/fs/cgroup/unified"} {
+		if _, err := os.Stat(filepath.Join(root, "cgroup.controllers")); err != nil || len(own) == 0 {
+			continue
+		}
+		parent, err := os.MkdirTemp(filepath.Join(root, own), "pine-test-")
+		if err != nil {
+			t.Skipf("cannot create a cgroup: %v", err)
+		}
+		t.Cleanup(func() {
+			// cgroups are removed bottom up, each with rmdir
+			trees, _ := filepath.Glob(filepath.Join(parent, "pine.slice", "*", "cgroup.procs"))
+			for _, procs := range trees {
+				os.Remove(filepath.Dir(procs))
+			}
+			os.Remove(filepath.Join(parent, "pine.slice"))
+			if err := os.Remove(parent); err != nil {
+				t.Errorf("failed to remove test cgroup: %v", err)
+			}
+		})
+		return parent
+	}
+	t.Skip("no cgroup v2 hierarchy")
+	return ""
+}
+
+func TestCgroup(t *testing.T) {
+	testTreeCgroup(t)
+}
+
+// Without clone3 into a cgroup, the exec helper moves the tree into its cgroup.
+func TestCgroupWithoutClone(t *testing.T) {
+	defer func(clone bool) { tree.CloneIntoCgroup = clone }(tree.CloneIntoCgroup)
+	tree.CloneIntoCgroup = false
+	testTreeCgroup(t)
+}
+
+func testTreeCgroup(t *testing.T) {
+	defer func(parent string) { tree.CgroupParent = parent }(tree.CgroupParent)
+	tree.CgroupParent = testCgroup(t)
+
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Cgroup Test\nShell yes\nStopTimeout 1s\n"+
+		"Command setsid sleep 30 & echo $! > "+pidFile+"; exec sleep 30\n"))
+	noErr(t, err)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+	destroyed := false
+	defer func() {
+		if !destroyed {
+			treeImpl.Destroy(context.Background())
+		}
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if data, err := os.ReadFile(pidFile); err == nil && strings.HasSuffix(string(data), "\n") {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("tree did not write its child's pid")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	child := childPid(t, pidFile)
+	defer syscall.Kill(child, syscall.SIGKILL)
+
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if len(status.Cgroup) == 0 {
+		t.Skip("pine has no cgroup to place trees in")
+	}
+	if status.Cgroup != filepath.Join(tree.CgroupParent, "pine.slice", `Cgroup\x20Test`) {
+		t.Errorf("unexpected cgroup: %s", status.Cgroup)
+	}
+	data, err := os.ReadFile(filepath.Join(status.Cgroup, "cgroup.procs"))
+	noErr(t, err)
+	procs := strings.Fields(string(data))
+	for _, pid := range []int{status.Pid, child} {
+		if !slices.Contains(procs, strconv.Itoa(pid)) {
+			t.Errorf("expected %d in the tree's cgroup, got %q", pid, procs)
+		}
+	}
+
+	// destroying the tree stops it and removes its cgroup before Start returns
+	destroyed = true
+	noErr(t, treeImpl.Destroy(context.Background()))
+	select {
+	case <-errChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tree did not stop")
+	}
+	if processAlive(child) {
+		t.Errorf("process %d that left the tree's process group survived stop", child)
+	}
+	if _, err := os.Stat(status.Cgroup); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("the tree's cgroup was not removed: %v", err)
+	}
+}
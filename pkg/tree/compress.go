@@ -0,0 +1,126 @@
+package tree
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression is how rotated log files are compressed.
+type Compression string
+
+const (
+	NoCompression   Compression = "none"
+	GzipCompression Compression = "gzip"
+	ZstdCompression Compression = "zstd"
+)
+
+var compressions = []Compression{GzipCompression, ZstdCompression}
+
+// ext returns the extension of files compressed with c, or "" if c does not
+// compress.
+func (c Compression) ext() string {
+	switch c {
+	case GzipCompression:
+		return ".gz"
+	case ZstdCompression:
+		return ".zst"
+	}
+	return ""
+}
+
+func (c Compression) newWriter(w io.Writer) (io.WriteCloser, error) {
+	switch c {
+	case GzipCompression:
+		return gzip.NewWriter(w), nil
+	case ZstdCompression:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", c)
+}
+
+func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
+	switch c {
+	case GzipCompression:
+		return gzip.NewReader(r)
+	case ZstdCompression:
+		decoder, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression '%s'", c)
+}
+
+// compressFile replaces filename with its compressed copy, which keeps its
+// modification time. The copy is written under a temporary name first, so that
+// a compressed file is always complete.
+func compressFile(filename string, c Compression) (err error) {
+	src, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	compressed := filename + c.ext()
+	tmpName := compressed + ".tmp"
+	dst, err := os.OpenFile(tmpName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			dst.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	zw, err := c.newWriter(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(zw, src); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+	if err = os.Chtimes(tmpName, stat.ModTime(), stat.ModTime()); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpName, compressed); err != nil {
+		return err
+	}
+	return os.Remove(filename)
+}
+
+// decompressFile returns an unnamed temporary file with the contents of the
+// compressed file f, and its size.
+func decompressFile(f *os.File, c Compression) (*os.File, int64, error) {
+	zr, err := c.newReader(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer zr.Close()
+	tmp, err := os.CreateTemp("", "pine-log-")
+	if err != nil {
+		return nil, 0, err
+	}
+	os.Remove(tmp.Name())
+	size, err := io.Copy(tmp, zr)
+	if err != nil {
+		tmp.Close()
+		return nil, 0, err
+	}
+	return tmp, size, nil
+}
@@ -4,10 +4,14 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"math"
+	"net"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -15,15 +19,80 @@ type Config struct {
 	Name       string
 	OriginFile string // required
 	Command    string // required
+	Shell      bool
 	User       string
 
-	EnvironmentFile string
+	Group               string // overrides the primary group of User
+	SupplementaryGroups []string
+	WorkingDirectory    string
+	UMask               int     // -1 keeps pine's umask
+	Limits              []Limit // by Limit directive, e.g. LimitNOFILE
+
+	// resource control of the tree's cgroup, 0 leaves the resource unlimited
+	// or at its default weight
+	MemoryMax  int64 // bytes
+	MemoryHigh int64 // bytes
+	CPUQuota   int   // percent of one CPU
+	CPUWeight  int
+	IOWeight   int
+	TasksMax   int64
+
+	Type            Type
+	PIDFile         string
+	StartTimeout    time.Duration
+	RemainAfterExit bool
+	WatchdogSec     time.Duration
+
+	Environment      []string // KEY=value
+	EnvironmentFiles []EnvFile
+	PassEnvironment  []string // pine's variables passed to the tree, all if empty
+	UnsetEnvironment []string
+
 	LogFile         string
 	MaxLogAge       int
+	MaxLogSize      int64
+	MaxLogFiles     int
+	MaxLogTotalSize int64
+	LogCompress     Compression
+	StandardOutput  Output
+	StandardError   Output
+	LogTimestamps   bool
+	LogFormat       LogFormat
+	SyslogAddress   SyslogAddress
+
+	OutputBufferLines int // recent output lines kept in memory
 
 	Restart         RestartLevel
 	RestartAttempts int
 	RestartDelay    time.Duration
+
+	SuccessExitStatus  []int
+	SuccessExitSignals []syscall.Signal
+
+	RestartBackoff       float64
+	RestartMaxDelay      time.Duration
+	RestartResetAfter    time.Duration
+	RestartLimitBurst    int
+	RestartLimitInterval time.Duration
+
+	StopSignal  syscall.Signal
+	StopTimeout time.Duration
+	KillMode    KillMode
+
+	Requires []string
+	Wants    []string
+	After    []string
+	BindsTo  []string
+
+	HealthCheck          HealthCheck
+	HealthCheckInterval  time.Duration
+	HealthCheckTimeout   time.Duration
+	HealthCheckThreshold int
+	HealthCheckRestart   bool
+
+	AutoStart  bool // whether the tree is enabled until it is enabled or disabled explicitly
+	Schedule   Schedule
+	Persistent bool
 }
 
 type RestartLevel string
@@ -32,6 +101,55 @@ const (
 	AlwaysRestart  RestartLevel = "always"
 	NeverRestart   RestartLevel = "never"
 	LimitedRestart RestartLevel = "limited"
+
+	OnFailureRestart  RestartLevel = "on-failure"
+	OnSuccessRestart  RestartLevel = "on-success"
+	OnAbnormalRestart RestartLevel = "on-abnormal"
+)
+
+// Type determines when a tree counts as started.
+type Type string
+
+const (
+	SimpleType  Type = "simple"  // started as soon as its process is
+	NotifyType  Type = "notify"  // started once it sends READY=1 to NOTIFY_SOCKET
+	OneshotType Type = "oneshot" // started once its process exits
+	ForkingType Type = "forking" // started once its parent exits, leaving the main process in PIDFile
+)
+
+// Output is where a standard stream of a tree goes: one of the outputs below
+// or the absolute path of a file.
+type Output string
+
+const (
+	LogOutput     Output = "log"     // the tree's LogFile
+	InheritOutput Output = "inherit" // pine's own log
+	NullOutput    Output = "null"
+	SyslogOutput  Output = "syslog"  // the SyslogAddress of the tree
+	JournalOutput Output = "journal" // the native journald socket
+)
+
+// SyslogAddress is the syslog socket a tree logs to, a unix socket or a UDP
+// host and port.
+type SyslogAddress struct {
+	Network string // unix or udp
+	Address string
+}
+
+// LogFormat is how output lines are written to files.
+type LogFormat string
+
+const (
+	TextLogFormat LogFormat = "text" // the line as is
+	JSONLogFormat LogFormat = "json" // the line in a JSON object with where it came from
+)
+
+type KillMode string
+
+const (
+	ProcessKillMode KillMode = "process"
+	GroupKillMode   KillMode = "group"
+	MixedKillMode   KillMode = "mixed"
 )
 
 var (
@@ -43,10 +161,35 @@ func LoadConfig(filename string) (Config, error) {
 		OriginFile: filename,
 		// defaults
 		User:            DefaultUser,
+		UMask:           -1,
+		AutoStart:       true,
+		Type:            SimpleType,
+		StartTimeout:    90 * time.Second,
 		MaxLogAge:       7,
+		LogCompress:     NoCompression,
+		StandardOutput:  LogOutput,
+		StandardError:   LogOutput,
+		LogFormat:       TextLogFormat,
+		SyslogAddress:   SyslogAddress{Network: "unix", Address: "/dev/log"},
 		Restart:         NeverRestart,
 		RestartAttempts: 3,
 		RestartDelay:    3 * time.Second,
+		// backoff
+		RestartBackoff:       1,
+		RestartMaxDelay:      5 * time.Minute,
+		RestartResetAfter:    time.Minute,
+		RestartLimitBurst:    5,
+		RestartLimitInterval: 10 * time.Second,
+		// stopping
+		StopSignal:  syscall.SIGTERM,
+		StopTimeout: 10 * time.Second,
+		KillMode:    GroupKillMode,
+		// health checks
+		HealthCheckInterval:  10 * time.Second,
+		HealthCheckTimeout:   5 * time.Second,
+		HealthCheckThreshold: 3,
+		// output
+		OutputBufferLines: 100,
 	}
 	fp, err := os.Open(filename)
 	if err != nil {
@@ -56,6 +199,7 @@ func LoadConfig(filename string) (Config, error) {
 
 	scanner := bufio.NewScanner(fp)
 	lineNum := 0
+	commandLine := 0
 	for scanner.Scan() {
 		line := scanner.Text()
 		lineNum++
@@ -71,21 +215,169 @@ func LoadConfig(filename string) (Config, error) {
 		value := strings.Trim(parts[1], " \t")
 		switch param {
 		default:
-			return cfg, fmt.Errorf("unknown parameter '%s' on line %d", param, lineNum)
+			resource, ok := strings.CutPrefix(param, "Limit")
+			if _, known := limitResources[resource]; !ok || !known {
+				return cfg, fmt.Errorf("unknown parameter '%s' on line %d", param, lineNum)
+			}
+			limit, err := parseLimit(resource, value)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid limit '%s' on line %d", value, lineNum)
+			}
+			cfg.Limits = slices.DeleteFunc(cfg.Limits, func(l Limit) bool { return l.Resource == resource })
+			cfg.Limits = append(cfg.Limits, limit)
 		case "Name":
 			cfg.Name = value
 		case "Command":
 			cfg.Command = value
+			commandLine = lineNum
+		case "Shell":
+			if cfg.Shell, err = parseBool(value); err != nil {
+				return cfg, fmt.Errorf("invalid shell value '%s' on line %d", value, lineNum)
+			}
 		case "User":
 			cfg.User = value
+		case "Group":
+			cfg.Group = value
+		case "SupplementaryGroups":
+			cfg.SupplementaryGroups = append(cfg.SupplementaryGroups, strings.Fields(value)...)
+		case "WorkingDirectory":
+			if !filepath.IsAbs(value) {
+				return cfg, fmt.Errorf("invalid working directory '%s' on line %d", value, lineNum)
+			}
+			cfg.WorkingDirectory = filepath.Clean(value)
+		case "UMask":
+			umask, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || umask > 0777 {
+				return cfg, fmt.Errorf("invalid umask '%s' on line %d", value, lineNum)
+			}
+			cfg.UMask = int(umask)
+		case "MemoryMax":
+			if cfg.MemoryMax, err = parseCgroupLimit(value); err != nil {
+				return cfg, fmt.Errorf("invalid memory max '%s' on line %d", value, lineNum)
+			}
+		case "MemoryHigh":
+			if cfg.MemoryHigh, err = parseCgroupLimit(value); err != nil {
+				return cfg, fmt.Errorf("invalid memory high '%s' on line %d", value, lineNum)
+			}
+		case "CPUQuota":
+			percent, ok := strings.CutSuffix(value, "%")
+			if cfg.CPUQuota, err = strconv.Atoi(percent); !ok || err != nil || cfg.CPUQuota <= 0 {
+				return cfg, fmt.Errorf("invalid cpu quota '%s' on line %d", value, lineNum)
+			}
+		case "CPUWeight":
+			if cfg.CPUWeight, err = parseWeight(value); err != nil {
+				return cfg, fmt.Errorf("invalid cpu weight '%s' on line %d", value, lineNum)
+			}
+		case "IOWeight":
+			if cfg.IOWeight, err = parseWeight(value); err != nil {
+				return cfg, fmt.Errorf("invalid io weight '%s' on line %d", value, lineNum)
+			}
+		case "TasksMax":
+			if value == "infinity" {
+				cfg.TasksMax = 0
+			} else if cfg.TasksMax, err = strconv.ParseInt(value, 10, 64); err != nil || cfg.TasksMax <= 0 {
+				return cfg, fmt.Errorf("invalid tasks max '%s' on line %d", value, lineNum)
+			}
+		case "Type":
+			switch value {
+			case "simple":
+				cfg.Type = SimpleType
+			case "notify":
+				cfg.Type = NotifyType
+			case "oneshot":
+				cfg.Type = OneshotType
+			case "forking":
+				cfg.Type = ForkingType
+			default:
+				return cfg, fmt.Errorf("unknown type '%s' on line %d", value, lineNum)
+			}
+		case "PIDFile":
+			cfg.PIDFile = value
+		case "StartTimeout":
+			if cfg.StartTimeout, err = time.ParseDuration(value); err != nil {
+				return cfg, fmt.Errorf("invalid start timeout '%s' on line %d", value, lineNum)
+			}
+		case "RemainAfterExit":
+			if cfg.RemainAfterExit, err = parseBool(value); err != nil {
+				return cfg, fmt.Errorf("invalid remain after exit '%s' on line %d", value, lineNum)
+			}
+		case "WatchdogSec":
+			// plain numbers are seconds, as in systemd
+			if secs, numErr := strconv.Atoi(value); numErr == nil {
+				cfg.WatchdogSec = time.Duration(secs) * time.Second
+			} else if cfg.WatchdogSec, err = time.ParseDuration(value); err != nil {
+				return cfg, fmt.Errorf("invalid watchdog interval '%s' on line %d", value, lineNum)
+			}
+		case "Environment":
+			kv, err := parseEnvAssignment(value)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid environment on line %d: %w", lineNum, err)
+			}
+			cfg.Environment = append(cfg.Environment, kv)
 		case "EnvironmentFile":
-			cfg.EnvironmentFile = value
+			path, optional := strings.CutPrefix(value, "-")
+			if len(path) == 0 {
+				return cfg, fmt.Errorf("invalid environment file '%s' on line %d", value, lineNum)
+			} else if !filepath.IsAbs(path) {
+				path = filepath.Join(filepath.Dir(filename), path)
+			}
+			cfg.EnvironmentFiles = append(cfg.EnvironmentFiles, EnvFile{Path: path, Optional: optional})
+		case "PassEnvironment":
+			cfg.PassEnvironment = append(cfg.PassEnvironment, strings.Fields(value)...)
+		case "UnsetEnvironment":
+			cfg.UnsetEnvironment = append(cfg.UnsetEnvironment, strings.Fields(value)...)
 		case "LogFile":
 			cfg.LogFile = value
 		case "MaxLogAge":
 			if cfg.MaxLogAge, err = strconv.Atoi(value); err != nil {
 				return cfg, errors.New("invalid max log age")
 			}
+		case "MaxLogSize":
+			if cfg.MaxLogSize, err = parseSize(value); err != nil {
+				return cfg, fmt.Errorf("invalid max log size '%s' on line %d", value, lineNum)
+			}
+		case "MaxLogFiles":
+			if cfg.MaxLogFiles, err = strconv.Atoi(value); err != nil {
+				return cfg, fmt.Errorf("invalid max log files '%s' on line %d", value, lineNum)
+			}
+		case "MaxLogTotalSize":
+			if cfg.MaxLogTotalSize, err = parseSize(value); err != nil {
+				return cfg, fmt.Errorf("invalid max log total size '%s' on line %d", value, lineNum)
+			}
+		case "LogCompress":
+			switch compress := Compression(value); compress {
+			case NoCompression, GzipCompression, ZstdCompression:
+				cfg.LogCompress = compress
+			default:
+				return cfg, fmt.Errorf("invalid log compression '%s' on line %d", value, lineNum)
+			}
+		case "StandardOutput":
+			if cfg.StandardOutput, err = parseOutput(value); err != nil {
+				return cfg, fmt.Errorf("invalid standard output '%s' on line %d", value, lineNum)
+			}
+		case "StandardError":
+			if cfg.StandardError, err = parseOutput(value); err != nil {
+				return cfg, fmt.Errorf("invalid standard error '%s' on line %d", value, lineNum)
+			}
+		case "LogTimestamps":
+			if cfg.LogTimestamps, err = parseBool(value); err != nil {
+				return cfg, fmt.Errorf("invalid log timestamps '%s' on line %d", value, lineNum)
+			}
+		case "LogFormat":
+			switch format := LogFormat(value); format {
+			case TextLogFormat, JSONLogFormat:
+				cfg.LogFormat = format
+			default:
+				return cfg, fmt.Errorf("invalid log format '%s' on line %d", value, lineNum)
+			}
+		case "SyslogAddress":
+			if cfg.SyslogAddress, err = parseSyslogAddress(value); err != nil {
+				return cfg, fmt.Errorf("invalid syslog address on line %d: %w", lineNum, err)
+			}
+		case "OutputBufferLines":
+			if cfg.OutputBufferLines, err = strconv.Atoi(value); err != nil {
+				return cfg, fmt.Errorf("invalid output buffer lines '%s' on line %d", value, lineNum)
+			}
 		case "Restart":
 			switch value {
 			case "always":
@@ -94,6 +386,12 @@ func LoadConfig(filename string) (Config, error) {
 				cfg.Restart = NeverRestart
 			case "limited":
 				cfg.Restart = LimitedRestart
+			case "on-failure":
+				cfg.Restart = OnFailureRestart
+			case "on-success":
+				cfg.Restart = OnSuccessRestart
+			case "on-abnormal":
+				cfg.Restart = OnAbnormalRestart
 			default:
 				return cfg, fmt.Errorf("unknown restart value '%s' on line %d", value, lineNum)
 			}
@@ -105,6 +403,103 @@ func LoadConfig(filename string) (Config, error) {
 			if cfg.RestartDelay, err = time.ParseDuration(value); err != nil {
 				return cfg, fmt.Errorf("invalid restart delay '%s' on line %d", value, lineNum)
 			}
+		case "SuccessExitStatus":
+			for _, status := range strings.Fields(value) {
+				code, codeErr := strconv.Atoi(status)
+				sig, sigErr := parseSignal(status)
+				if codeErr == nil && code >= 0 && code <= 255 {
+					cfg.SuccessExitStatus = append(cfg.SuccessExitStatus, code)
+				} else if codeErr != nil && sigErr == nil {
+					cfg.SuccessExitSignals = append(cfg.SuccessExitSignals, sig)
+				} else {
+					return cfg, fmt.Errorf("invalid success exit status '%s' on line %d", status, lineNum)
+				}
+			}
+		case "RestartBackoff":
+			if cfg.RestartBackoff, err = strconv.ParseFloat(value, 64); err != nil {
+				return cfg, fmt.Errorf("invalid restart backoff '%s' on line %d", value, lineNum)
+			}
+		case "RestartMaxDelay":
+			if cfg.RestartMaxDelay, err = time.ParseDuration(value); err != nil {
+				return cfg, fmt.Errorf("invalid restart max delay '%s' on line %d", value, lineNum)
+			}
+		case "RestartResetAfter":
+			if cfg.RestartResetAfter, err = time.ParseDuration(value); err != nil {
+				return cfg, fmt.Errorf("invalid restart reset after '%s' on line %d", value, lineNum)
+			}
+		case "RestartLimitBurst":
+			if cfg.RestartLimitBurst, err = strconv.Atoi(value); err != nil {
+				return cfg, fmt.Errorf("invalid restart limit burst '%s' on line %d", value, lineNum)
+			}
+		case "RestartLimitInterval":
+			if cfg.RestartLimitInterval, err = time.ParseDuration(value); err != nil {
+				return cfg, fmt.Errorf("invalid restart limit interval '%s' on line %d", value, lineNum)
+			}
+		case "StopSignal":
+			if cfg.StopSignal, err = parseSignal(value); err != nil {
+				return cfg, fmt.Errorf("invalid stop signal '%s' on line %d", value, lineNum)
+			}
+		case "StopTimeout":
+			if cfg.StopTimeout, err = time.ParseDuration(value); err != nil {
+				return cfg, fmt.Errorf("invalid stop timeout '%s' on line %d", value, lineNum)
+			}
+		case "KillMode":
+			switch value {
+			case "process":
+				cfg.KillMode = ProcessKillMode
+			case "group":
+				cfg.KillMode = GroupKillMode
+			case "mixed":
+				cfg.KillMode = MixedKillMode
+			default:
+				return cfg, fmt.Errorf("unknown kill mode '%s' on line %d", value, lineNum)
+			}
+		case "Requires":
+			cfg.Requires = append(cfg.Requires, strings.Fields(value)...)
+		case "Wants":
+			cfg.Wants = append(cfg.Wants, strings.Fields(value)...)
+		case "After":
+			cfg.After = append(cfg.After, strings.Fields(value)...)
+		case "BindsTo":
+			cfg.BindsTo = append(cfg.BindsTo, strings.Fields(value)...)
+		case "HealthCheck":
+			if cfg.HealthCheck, err = parseHealthCheck(value); err != nil {
+				return cfg, fmt.Errorf("invalid health check on line %d: %w", lineNum, err)
+			}
+		case "HealthCheckInterval":
+			if cfg.HealthCheckInterval, err = time.ParseDuration(value); err != nil {
+				return cfg, fmt.Errorf("invalid health check interval '%s' on line %d", value, lineNum)
+			}
+		case "HealthCheckTimeout":
+			if cfg.HealthCheckTimeout, err = time.ParseDuration(value); err != nil {
+				return cfg, fmt.Errorf("invalid health check timeout '%s' on line %d", value, lineNum)
+			}
+		case "HealthCheckThreshold":
+			if cfg.HealthCheckThreshold, err = strconv.Atoi(value); err != nil {
+				return cfg, fmt.Errorf("invalid health check threshold '%s' on line %d", value, lineNum)
+			}
+		case "HealthCheckRestart":
+			if cfg.HealthCheckRestart, err = parseBool(value); err != nil {
+				return cfg, fmt.Errorf("invalid health check restart '%s' on line %d", value, lineNum)
+			}
+		case "AutoStart":
+			if cfg.AutoStart, err = parseBool(value); err != nil {
+				return cfg, fmt.Errorf("invalid auto start '%s' on line %d", value, lineNum)
+			}
+		case "Schedule":
+			if cfg.Schedule, err = ParseSchedule(value); err != nil {
+				return cfg, fmt.Errorf("invalid schedule on line %d: %w", lineNum, err)
+			}
+		case "Persistent":
+			if cfg.Persistent, err = parseBool(value); err != nil {
+				return cfg, fmt.Errorf("invalid persistent '%s' on line %d", value, lineNum)
+			}
+		}
+	}
+
+	if len(cfg.Command) > 0 && !cfg.Shell {
+		if _, err := SplitCommand(cfg.Command, nil); err != nil {
+			return cfg, fmt.Errorf("invalid command on line %d: %w", commandLine, err)
 		}
 	}
 
@@ -124,8 +519,245 @@ func ValidateConfig(cfg *Config) error {
 	if len(cfg.LogFile) == 0 {
 		cfg.LogFile = fmt.Sprintf("/var/log/homelab/%s.log", cfg.Name)
 	}
+	for _, dep := range cfg.Dependencies() {
+		if dep == cfg.Name {
+			return errors.New("tree cannot depend on itself")
+		}
+	}
 	if cfg.MaxLogAge < 1 {
 		return errors.New("invalid max log age")
 	}
+	if cfg.MaxLogSize < 0 || cfg.MaxLogFiles < 0 || cfg.MaxLogTotalSize < 0 {
+		return errors.New("invalid max log size, files or total size")
+	}
+	if err := validateLimits(cfg.Limits); err != nil {
+		return err
+	}
+	if cfg.OutputBufferLines < 0 {
+		return errors.New("invalid output buffer lines")
+	}
+	if cfg.RestartBackoff < 1 {
+		return errors.New("invalid restart backoff, must be at least 1")
+	}
+	if cfg.RestartLimitBurst < 0 {
+		return errors.New("invalid restart limit burst")
+	}
+	if cfg.RestartLimitBurst > 0 && cfg.RestartLimitInterval <= 0 {
+		return errors.New("invalid restart limit interval")
+	}
+	if cfg.HealthCheckInterval <= 0 || cfg.HealthCheckTimeout <= 0 {
+		return errors.New("invalid health check interval or timeout")
+	}
+	if cfg.HealthCheckThreshold < 1 {
+		return errors.New("invalid health check threshold")
+	}
+	if cfg.StopTimeout <= 0 {
+		return errors.New("invalid stop timeout")
+	}
+	if cfg.StartTimeout <= 0 {
+		return errors.New("invalid start timeout")
+	}
+	if cfg.WatchdogSec < 0 {
+		return errors.New("invalid watchdog interval")
+	}
+	if cfg.Type == ForkingType && len(cfg.PIDFile) == 0 {
+		return errors.New("forking tree requires a pid file")
+	}
 	return nil
 }
+
+// LogRotation returns how the log files of the tree are rotated.
+func (c Config) LogRotation() LogRotation {
+	return LogRotation{
+		MaxAge:       time.Duration(c.MaxLogAge*24) * time.Hour,
+		MaxSize:      c.MaxLogSize,
+		MaxFiles:     c.MaxLogFiles,
+		MaxTotalSize: c.MaxLogTotalSize,
+		Compress:     c.LogCompress,
+	}
+}
+
+// resourceControl reports whether the tree configures any resource control
+// of its cgroup.
+func (c Config) resourceControl() bool {
+	return c.MemoryMax > 0 || c.MemoryHigh > 0 || c.CPUQuota > 0 || c.CPUWeight > 0 || c.IOWeight > 0 || c.TasksMax > 0
+}
+
+// Dependencies returns the names of all trees this tree is ordered after.
+// Trees listed in Requires, Wants and BindsTo are implicitly ordered as if
+// they were also listed in After.
+func (c Config) Dependencies() []string {
+	deps := []string{}
+	for _, list := range [][]string{c.Requires, c.BindsTo, c.Wants, c.After} {
+		for _, dep := range list {
+			if !slices.Contains(deps, dep) {
+				deps = append(deps, dep)
+			}
+		}
+	}
+	return deps
+}
+
+// parseHealthCheck parses a health check of the form "http <url>",
+// "tcp <host:port>" or "exec <command>".
+func parseHealthCheck(value string) (HealthCheck, error) {
+	kind, target, _ := strings.Cut(value, " ")
+	check := HealthCheck{
+		Type:   HealthCheckType(kind),
+		Target: strings.TrimSpace(target),
+	}
+	if len(check.Target) == 0 {
+		return check, errors.New("missing target")
+	}
+	switch check.Type {
+	case HTTPHealthCheck:
+		if !strings.HasPrefix(check.Target, "http://") && !strings.HasPrefix(check.Target, "https://") {
+			return check, fmt.Errorf("invalid url '%s'", check.Target)
+		}
+	case TCPHealthCheck:
+		if _, _, err := net.SplitHostPort(check.Target); err != nil {
+			return check, err
+		}
+	case ExecHealthCheck:
+		if _, err := SplitCommand(check.Target, nil); err != nil {
+			return check, err
+		}
+	default:
+		return check, fmt.Errorf("unknown type '%s'", kind)
+	}
+	return check, nil
+}
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix for
+// powers of 1024.
+func parseSize(value string) (int64, error) {
+	number := strings.TrimRight(value, "KMGT")
+	unit, ok := sizeUnits[value[len(number):]]
+	if !ok {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size < 0 || size > math.MaxInt64/unit {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return size * unit, nil
+}
+
+// parseCgroupLimit parses a positive size or "infinity", which is 0.
+func parseCgroupLimit(value string) (int64, error) {
+	if value == "infinity" {
+		return 0, nil
+	}
+	size, err := parseSize(value)
+	if err == nil && size == 0 {
+		err = fmt.Errorf("invalid size '%s'", value)
+	}
+	return size, err
+}
+
+// parseWeight parses a cgroup weight, from 1 to 10000.
+func parseWeight(value string) (int, error) {
+	weight, err := strconv.Atoi(value)
+	if err != nil || weight < 1 || weight > 10000 {
+		return 0, fmt.Errorf("invalid weight '%s'", value)
+	}
+	return weight, nil
+}
+
+// parseSyslogAddress parses a syslog address of the form "unix <path>" or
+// "udp <host:port>".
+func parseSyslogAddress(value string) (SyslogAddress, error) {
+	network, address, _ := strings.Cut(value, " ")
+	addr := SyslogAddress{
+		Network: network,
+		Address: strings.TrimSpace(address),
+	}
+	if len(addr.Address) == 0 {
+		return addr, errors.New("missing address")
+	}
+	switch addr.Network {
+	case "unix":
+		if !filepath.IsAbs(addr.Address) {
+			return addr, fmt.Errorf("invalid path '%s'", addr.Address)
+		}
+	case "udp":
+		if _, _, err := net.SplitHostPort(addr.Address); err != nil {
+			return addr, err
+		}
+	default:
+		return addr, fmt.Errorf("unknown network '%s'", network)
+	}
+	return addr, nil
+}
+
+func parseOutput(value string) (Output, error) {
+	switch output := Output(value); output {
+	case LogOutput, InheritOutput, NullOutput, SyslogOutput, JournalOutput:
+		return output, nil
+	}
+	if !filepath.IsAbs(value) {
+		return "", fmt.Errorf("invalid output '%s'", value)
+	}
+	return Output(filepath.Clean(value)), nil
+}
+
+func parseBool(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "yes", "true", "on", "1":
+		return true, nil
+	case "no", "false", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean '%s'", value)
+}
+
+var signalNames = map[string]syscall.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"ABRT":  syscall.SIGABRT,
+	"KILL":  syscall.SIGKILL,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"ALRM":  syscall.SIGALRM,
+	"TERM":  syscall.SIGTERM,
+	"CONT":  syscall.SIGCONT,
+	"STOP":  syscall.SIGSTOP,
+	"TSTP":  syscall.SIGTSTP,
+	"WINCH": syscall.SIGWINCH,
+	"PWR":   syscall.SIGPWR,
+}
+
+// signalName returns the conventional name of sig, such as SIGTERM.
+func signalName(sig syscall.Signal) string {
+	for name, s := range signalNames {
+		if s == sig {
+			return "SIG" + name
+		}
+	}
+	return sig.String()
+}
+
+// parseSignal accepts a signal name with or without the SIG prefix, such as
+// SIGTERM or INT, or a signal number.
+func parseSignal(value string) (syscall.Signal, error) {
+	if num, err := strconv.Atoi(value); err == nil {
+		if num < 1 || num > 64 {
+			return 0, fmt.Errorf("invalid signal number %d", num)
+		}
+		return syscall.Signal(num), nil
+	}
+	sig, ok := signalNames[strings.TrimPrefix(strings.ToUpper(value), "SIG")]
+	if !ok {
+		return 0, fmt.Errorf("unknown signal '%s'", value)
+	}
+	return sig, nil
+}
@@ -1,7 +1,12 @@
 package tree_test
 
 import (
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	tree "github.com/mpoegel/pine/pkg/tree"
 )
@@ -32,3 +37,213 @@ func TestLoadConfigUser(t *testing.T) {
 		t.Errorf("unexpected user: '%s'", cfg.User)
 	}
 }
+
+func TestLoadConfigProcess(t *testing.T) {
+	cfg, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nGroup docker\nSupplementaryGroups adm video\n"+
+		"SupplementaryGroups audio\nWorkingDirectory /srv/app/\nUMask 0027\n"))
+	noErr(t, err)
+	if cfg.Group != "docker" || strings.Join(cfg.SupplementaryGroups, " ") != "adm video audio" {
+		t.Errorf("unexpected groups: %s %v", cfg.Group, cfg.SupplementaryGroups)
+	}
+	if cfg.WorkingDirectory != "/srv/app" || cfg.UMask != 0o027 {
+		t.Errorf("unexpected working directory %s or umask %o", cfg.WorkingDirectory, cfg.UMask)
+	}
+
+	for _, line := range []string{"WorkingDirectory srv/app", "UMask 0999", "UMask 1777"} {
+		if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\n"+line+"\n")); err == nil {
+			t.Errorf("expected error for %s", line)
+		}
+	}
+}
+
+func TestLoadConfigEnvironment(t *testing.T) {
+	filename := createTreeFile(t, "Command sleep 1\nEnvironment A=1\nEnvironment B='x y'\n"+
+		"EnvironmentFile /etc/a.env\nEnvironmentFile -/etc/b.env\nEnvironmentFile c.env\n")
+	cfg, err := tree.LoadConfig(filename)
+	noErr(t, err)
+	if strings.Join(cfg.Environment, ",") != "A=1,B=x y" {
+		t.Errorf("unexpected environment: %q", cfg.Environment)
+	}
+	want := []tree.EnvFile{{Path: "/etc/a.env"}, {Path: "/etc/b.env", Optional: true},
+		{Path: filepath.Join(filepath.Dir(filename), "c.env")}}
+	if !slices.Equal(cfg.EnvironmentFiles, want) {
+		t.Errorf("unexpected environment files: %+v", cfg.EnvironmentFiles)
+	}
+
+	for _, line := range []string{"Environment A", "Environment 1A=1", "Environment A=\"1", "EnvironmentFile -"} {
+		if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\n"+line+"\n")); err == nil {
+			t.Errorf("expected error for %s", line)
+		}
+	}
+}
+
+func TestLoadConfigLimits(t *testing.T) {
+	cfg, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nLimitNOFILE 1024\nLimitAS 1G:infinity\nLimitNOFILE 4K\n"))
+	noErr(t, err)
+	want := []string{"AS=1073741824:infinity", "NOFILE=4096"}
+	got := []string{}
+	for _, limit := range cfg.Limits {
+		got = append(got, limit.Resource+"="+limit.String())
+	}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("unexpected limits: %v", got)
+	}
+
+	for _, line := range []string{"LimitFOO 1", "LimitNOFILE many", "LimitNOFILE 2048:1024"} {
+		if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\n"+line+"\n")); err == nil {
+			t.Errorf("expected error for %s", line)
+		}
+	}
+}
+
+func TestLoadConfigResourceControl(t *testing.T) {
+	cfg, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nMemoryMax 1G\nMemoryHigh infinity\n"+
+		"CPUQuota 150%\nCPUWeight 200\nIOWeight 50\nTasksMax 64\n"))
+	noErr(t, err)
+	if cfg.MemoryMax != 1<<30 || cfg.MemoryHigh != 0 || cfg.CPUQuota != 150 || cfg.CPUWeight != 200 ||
+		cfg.IOWeight != 50 || cfg.TasksMax != 64 {
+		t.Errorf("unexpected resource control: %+v", cfg)
+	}
+
+	for _, line := range []string{"MemoryMax 0", "MemoryHigh lots", "CPUQuota 50", "CPUQuota 0%",
+		"CPUWeight 0", "IOWeight 10001", "TasksMax -1"} {
+		if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\n"+line+"\n")); err == nil {
+			t.Errorf("expected error for %s", line)
+		}
+	}
+}
+
+func TestLoadConfigShell(t *testing.T) {
+	cfg, err := tree.LoadConfig("testdata/shell.tree")
+	noErr(t, err)
+
+	if !cfg.Shell {
+		t.Error("expected shell to be enabled")
+	}
+	if cfg.Command != "echo $(date) | tee /dev/null" {
+		t.Errorf("unexpected command: '%s'", cfg.Command)
+	}
+}
+
+func TestLoadConfigInvalidCommand(t *testing.T) {
+	_, err := tree.LoadConfig("testdata/badcommand.tree")
+	if err == nil {
+		t.Fatal("expected error for unterminated quote")
+	}
+	if !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("expected line number in error: %v", err)
+	}
+}
+
+func TestLoadConfigStopSignal(t *testing.T) {
+	cfg, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nStopSignal INT\nStopTimeout 30s\n"))
+	noErr(t, err)
+
+	if cfg.StopSignal != syscall.SIGINT {
+		t.Errorf("unexpected stop signal: %s", cfg.StopSignal)
+	}
+	if cfg.StopTimeout != 30*time.Second {
+		t.Errorf("unexpected stop timeout: %s", cfg.StopTimeout)
+	}
+
+	if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nStopSignal SIGNOPE\n")); err == nil {
+		t.Error("expected error for unknown signal")
+	}
+}
+
+func TestLoadConfigRestartBackoff(t *testing.T) {
+	cfg, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nRestartBackoff 1.5\nRestartMaxDelay 1m\nRestartResetAfter 30s\nRestartLimitBurst 8\nRestartLimitInterval 1m\n"))
+	noErr(t, err)
+
+	if cfg.RestartBackoff != 1.5 || cfg.RestartMaxDelay != time.Minute || cfg.RestartResetAfter != 30*time.Second {
+		t.Errorf("unexpected backoff: %v %s %s", cfg.RestartBackoff, cfg.RestartMaxDelay, cfg.RestartResetAfter)
+	}
+	if cfg.RestartLimitBurst != 8 || cfg.RestartLimitInterval != time.Minute {
+		t.Errorf("unexpected restart limit: %d %s", cfg.RestartLimitBurst, cfg.RestartLimitInterval)
+	}
+
+	if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nRestartBackoff 0.5\n")); err == nil {
+		t.Error("expected error for backoff below 1")
+	}
+}
+
+func TestLoadConfigDependencies(t *testing.T) {
+	cfg, err := tree.LoadConfig(createTreeFile(t, "Name app\nCommand sleep 1\nRequires db cache\nWants metrics\nAfter network\nAfter db\nBindsTo proxy\n"))
+	noErr(t, err)
+
+	if len(cfg.Requires) != 2 || len(cfg.Wants) != 1 || len(cfg.After) != 2 || len(cfg.BindsTo) != 1 {
+		t.Errorf("unexpected dependencies: %v %v %v %v", cfg.Requires, cfg.Wants, cfg.After, cfg.BindsTo)
+	}
+	if deps := cfg.Dependencies(); len(deps) != 5 {
+		t.Errorf("unexpected ordering dependencies: %v", deps)
+	}
+
+	if _, err := tree.LoadConfig(createTreeFile(t, "Name app\nCommand sleep 1\nAfter app\n")); err == nil {
+		t.Error("expected error for self dependency")
+	}
+}
+
+func TestLoadConfigHealthCheck(t *testing.T) {
+	cfg, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nHealthCheck tcp localhost:8080\nHealthCheckInterval 1s\nHealthCheckTimeout 500ms\nHealthCheckThreshold 5\nHealthCheckRestart yes\n"))
+	noErr(t, err)
+
+	if cfg.HealthCheck.Type != tree.TCPHealthCheck || cfg.HealthCheck.Target != "localhost:8080" {
+		t.Errorf("unexpected health check: %+v", cfg.HealthCheck)
+	}
+	if cfg.HealthCheckInterval != time.Second || cfg.HealthCheckTimeout != 500*time.Millisecond || cfg.HealthCheckThreshold != 5 || !cfg.HealthCheckRestart {
+		t.Errorf("unexpected health check settings: %+v", cfg)
+	}
+
+	for _, check := range []string{"http localhost", "tcp localhost", "exec 'oops", "ping localhost", "tcp"} {
+		if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nHealthCheck "+check+"\n")); err == nil {
+			t.Errorf("expected error for health check '%s'", check)
+		}
+	}
+}
+
+func TestLoadConfigType(t *testing.T) {
+	cfg, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nType forking\nPIDFile /run/test.pid\nStartTimeout 5s\n"))
+	noErr(t, err)
+
+	if cfg.Type != tree.ForkingType || cfg.PIDFile != "/run/test.pid" || cfg.StartTimeout != 5*time.Second {
+		t.Errorf("unexpected type settings: %+v", cfg)
+	}
+
+	if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nType forking\n")); err == nil {
+		t.Error("expected error for forking tree without pid file")
+	}
+	if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nType idle\n")); err == nil {
+		t.Error("expected error for unknown type")
+	}
+
+	for value, expected := range map[string]time.Duration{"30": 30 * time.Second, "1m30s": 90 * time.Second} {
+		cfg, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nType notify\nWatchdogSec "+value+"\n"))
+		noErr(t, err)
+		if cfg.WatchdogSec != expected {
+			t.Errorf("unexpected watchdog interval for '%s': %s", value, cfg.WatchdogSec)
+		}
+	}
+}
+
+func TestLoadConfigOutput(t *testing.T) {
+	cfg, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nStandardOutput null\nStandardError /var/log/test/../err.log\n"))
+	noErr(t, err)
+	if cfg.StandardOutput != tree.NullOutput || cfg.StandardError != "/var/log/err.log" {
+		t.Errorf("unexpected outputs: %s %s", cfg.StandardOutput, cfg.StandardError)
+	}
+
+	if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nStandardOutput err.log\n")); err == nil {
+		t.Error("expected error for relative output path")
+	}
+
+	cfg, err = tree.LoadConfig(createTreeFile(t, "Command sleep 1\nStandardOutput journal\nSyslogAddress udp 10.0.0.1:514\n"))
+	noErr(t, err)
+	if cfg.StandardOutput != tree.JournalOutput || cfg.SyslogAddress != (tree.SyslogAddress{Network: "udp", Address: "10.0.0.1:514"}) {
+		t.Errorf("unexpected output: %s %+v", cfg.StandardOutput, cfg.SyslogAddress)
+	}
+	for _, addr := range []string{"tcp 10.0.0.1:514", "unix dev/log", "udp 10.0.0.1"} {
+		if _, err := tree.LoadConfig(createTreeFile(t, "Command sleep 1\nSyslogAddress "+addr+"\n")); err == nil {
+			t.Errorf("expected error for syslog address %s", addr)
+		}
+	}
+}
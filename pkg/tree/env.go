@@ -0,0 +1,218 @@
+package tree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+)
+
+// defaultPath is the PATH of a tree that does not get one from pine.
+const defaultPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// EnvFile is an environment file of a tree. A missing optional file is
+// skipped.
+type EnvFile struct {
+	Path     string
+	Optional bool
+}
+
+// environment returns the environment a tree's command runs with, each later
+// source overriding the earlier ones:
+//
+//   - pine's environment, only the PassEnvironment variables if any are set
+//   - HOME, USER, LOGNAME and SHELL of the tree's user, and a default PATH
+//   - the EnvironmentFile entries, in order
+//   - the Environment directives
+//
+// Variables in UnsetEnvironment are removed last.
+func (t *TreeImpl) environment(cfg Config) ([]string, error) {
+	env := envList{}
+	for _, kv := range os.Environ() {
+		key, value, _ := strings.Cut(kv, "=")
+		if len(cfg.PassEnvironment) == 0 || slices.Contains(cfg.PassEnvironment, key) {
+			env.set(key, value)
+		}
+	}
+
+	u, err := user.Lookup(cfg.User)
+	if err != nil {
+		return nil, err
+	}
+	env.set("HOME", u.HomeDir)
+	env.set("USER", u.Username)
+	env.set("LOGNAME", u.Username)
+	env.set("SHELL", userShell(u.Username))
+	if _, ok := env.get("PATH"); !ok {
+		env.set("PATH", defaultPath)
+	}
+
+	for _, file := range cfg.EnvironmentFiles {
+		vars, err := loadEnvFile(file.Path)
+		if errors.Is(err, os.ErrNotExist) && file.Optional {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, kv := range vars {
+			key, value, _ := strings.Cut(kv, "=")
+			env.set(key, value)
+		}
+	}
+	for _, kv := range cfg.Environment {
+		key, value, _ := strings.Cut(kv, "=")
+		env.set(key, value)
+	}
+
+	for _, key := range cfg.UnsetEnvironment {
+		env.unset(key)
+	}
+	return env.vars, nil
+}
+
+// envList is a list of KEY=value pairs with unique keys.
+type envList struct {
+	vars []string
+}
+
+func (e *envList) index(key string) int {
+	return slices.IndexFunc(e.vars, func(kv string) bool {
+		return strings.HasPrefix(kv, key+"=")
+	})
+}
+
+func (e *envList) get(key string) (string, bool) {
+	if i := e.index(key); i >= 0 {
+		return e.vars[i][len(key)+1:], true
+	}
+	return "", false
+}
+
+func (e *envList) set(key string, value string) {
+	if i := e.index(key); i >= 0 {
+		e.vars[i] = key + "=" + value
+		return
+	}
+	e.vars = append(e.vars, key+"="+value)
+}
+
+func (e *envList) unset(key string) {
+	if i := e.index(key); i >= 0 {
+		e.vars = slices.Delete(e.vars, i, i+1)
+	}
+}
+
+// userShell returns the login shell of username from /etc/passwd, or /bin/sh.
+func userShell(username string) string {
+	fp, err := os.Open("/etc/passwd")
+	if err != nil {
+		return "/bin/sh"
+	}
+	defer fp.Close()
+	scanner := bufio.NewScanner(fp)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == username && len(fields[6]) > 0 {
+			return fields[6]
+		}
+	}
+	return "/bin/sh"
+}
+
+// loadEnvFile reads a dotenv style environment file: KEY=value lines,
+// optionally prefixed with "export", where values may be quoted as in
+// parseEnvValue. Blank lines and lines starting with # are skipped.
+func loadEnvFile(filename string) ([]string, error) {
+	res := []string{}
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+
+	scanner := bufio.NewScanner(fp)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "export "); ok {
+			line = strings.TrimSpace(rest)
+		}
+		kv, err := parseEnvAssignment(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid environment file format in %s on line %d: %w", filename, lineNum, err)
+		}
+		res = append(res, kv)
+	}
+	return res, scanner.Err()
+}
+
+// parseEnvAssignment parses KEY=value into a KEY=value pair with the value
+// unquoted.
+func parseEnvAssignment(assignment string) (string, error) {
+	key, value, ok := strings.Cut(assignment, "=")
+	key = strings.TrimSpace(key)
+	if !ok || !isVariableName(key) {
+		return "", fmt.Errorf("invalid assignment '%s'", assignment)
+	}
+	value, err := parseEnvValue(strings.TrimSpace(value))
+	if err != nil {
+		return "", err
+	}
+	return key + "=" + value, nil
+}
+
+// parseEnvValue unquotes the value of an environment variable. Single quoted
+// values are taken literally, double quoted values may escape \", \\, \$ and
+// \n, and unquoted values end at a " #" comment.
+func parseEnvValue(value string) (string, error) {
+	if len(value) == 0 {
+		return "", nil
+	}
+	switch value[0] {
+	case '\'':
+		end := strings.IndexByte(value[1:], '\'')
+		if end < 0 {
+			return "", errors.New("unterminated quote")
+		}
+		return value[1 : end+1], afterQuote(value[end+2:])
+	case '"':
+		var b strings.Builder
+		for i := 1; i < len(value); i++ {
+			c := value[i]
+			if c == '"' {
+				return b.String(), afterQuote(value[i+1:])
+			}
+			if c == '\\' && i+1 < len(value) {
+				switch next := value[i+1]; next {
+				case '"', '\\', '$':
+					c = next
+					i++
+				case 'n':
+					c = '\n'
+					i++
+				}
+			}
+			b.WriteByte(c)
+		}
+		return "", errors.New("unterminated quote")
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
+
+// afterQuote checks that only a comment follows a quoted value.
+func afterQuote(rest string) error {
+	if rest = strings.TrimSpace(rest); len(rest) > 0 && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected '%s' after quoted value", rest)
+	}
+	return nil
+}
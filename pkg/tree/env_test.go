@@ -0,0 +1,81 @@
+package tree_test
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+func TestEnvironment(t *testing.T) {
+	t.Setenv("PINE_TEST_PASSED", "passed")
+	t.Setenv("PINE_TEST_DROPPED", "dropped")
+	dir := t.TempDir()
+	envFile := filepath.Join(dir, "test.env")
+	noErr(t, os.WriteFile(envFile, []byte(`# comment
+
+export FROM_FILE=file
+QUOTED="a \"b\" $c" # comment
+SINGLE='x y'
+UNQUOTED = plain value # comment
+OVERRIDDEN=file
+UNSET=me
+`), 0644))
+	filename := createTreeFile(t, "Name Env\nCommand env\nPassEnvironment PINE_TEST_PASSED\n"+
+		"EnvironmentFile "+envFile+"\nEnvironmentFile -"+filepath.Join(dir, "missing.env")+"\n"+
+		"Environment OVERRIDDEN=directive\nEnvironment SPACED=\"with spaces\"\nUnsetEnvironment UNSET\n")
+	treeImpl, err := tree.NewTree(filename)
+	noErr(t, err)
+	noErr(t, treeImpl.Start(context.Background()))
+
+	currUser, err := user.Current()
+	noErr(t, err)
+	data := readLog(t, filepath.Join(filepath.Dir(filename), "test.log"), 12)
+	env := strings.Split(strings.TrimSpace(string(data)), "\n")
+	for _, want := range []string{
+		"PINE_TEST_PASSED=passed",
+		"HOME=" + currUser.HomeDir,
+		"USER=" + currUser.Username,
+		"LOGNAME=" + currUser.Username,
+		"FROM_FILE=file",
+		`QUOTED=a "b" $c`,
+		"SINGLE=x y",
+		"UNQUOTED=plain value",
+		"OVERRIDDEN=directive",
+		"SPACED=with spaces",
+	} {
+		if !slices.Contains(env, want) {
+			t.Errorf("expected %s in %q", want, env)
+		}
+	}
+	for _, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if key == "PINE_TEST_DROPPED" || key == "UNSET" {
+			t.Errorf("unexpected %s", kv)
+		}
+	}
+	if !slices.ContainsFunc(env, func(kv string) bool { return strings.HasPrefix(kv, "PATH=") }) {
+		t.Errorf("expected a PATH in %q", env)
+	}
+}
+
+func TestEnvironmentFileErrors(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "test.env")
+	noErr(t, os.WriteFile(envFile, []byte("GOOD=1\nnot an assignment\n"), 0644))
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Env\nCommand env\nEnvironmentFile "+envFile+"\n"))
+	noErr(t, err)
+	if err := treeImpl.Start(context.Background()); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected error for line 2, got %v", err)
+	}
+
+	treeImpl, err = tree.NewTree(createTreeFile(t, "Name Env\nCommand env\nEnvironmentFile /nonexistent/test.env\n"))
+	noErr(t, err)
+	if err := treeImpl.Start(context.Background()); err == nil {
+		t.Error("expected error for missing environment file")
+	}
+}
@@ -0,0 +1,133 @@
+package tree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+type HealthCheckType string
+
+const (
+	HTTPHealthCheck HealthCheckType = "http"
+	TCPHealthCheck  HealthCheckType = "tcp"
+	ExecHealthCheck HealthCheckType = "exec"
+)
+
+// HealthCheck probes a running tree. Target is a URL for HTTP checks, a
+// host:port address for TCP checks, or a command line for exec checks.
+type HealthCheck struct {
+	Type   HealthCheckType
+	Target string
+}
+
+// Health is the result of a tree's health checks while it is running.
+type Health string
+
+const (
+	UnknownHealth Health = ""
+	Healthy       Health = "healthy"
+	Unhealthy     Health = "unhealthy"
+)
+
+// watchHealth probes the tree every interval until ctx is done. The tree
+// becomes unhealthy after the configured number of consecutive failures and
+// healthy again after a successful probe. If restarting unhealthy trees is
+// enabled, unhealthy is signalled once the threshold is reached.
+func (t *TreeImpl) watchHealth(ctx context.Context, cfg Config, env []string, unhealthy chan<- struct{}) {
+	ticker := time.NewTicker(cfg.HealthCheckInterval)
+	defer ticker.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := t.probe(ctx, cfg, env)
+		if ctx.Err() != nil {
+			return
+		}
+
+		t.stateMu.Lock()
+		prev := t.health
+		if err == nil {
+			failures = 0
+			t.health = Healthy
+		} else if failures++; failures >= cfg.HealthCheckThreshold {
+			t.health = Unhealthy
+		}
+		health := t.health
+		t.stateMu.Unlock()
+
+		if err != nil {
+			slog.Debug("health check failed", "name", cfg.Name, "failures", failures, "err", err)
+		}
+		if health == prev {
+			continue
+		}
+		slog.Info("tree health changed", "name", cfg.Name, "health", health)
+		if health == Unhealthy && cfg.HealthCheckRestart {
+			select {
+			case unhealthy <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (t *TreeImpl) probe(ctx context.Context, cfg Config, env []string) error {
+	ctx, cancel := context.WithTimeout(ctx, cfg.HealthCheckTimeout)
+	defer cancel()
+
+	switch cfg.HealthCheck.Type {
+	case HTTPHealthCheck:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.HealthCheck.Target, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("health check returned %s", resp.Status)
+		}
+		return nil
+	case TCPHealthCheck:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", cfg.HealthCheck.Target)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case ExecHealthCheck:
+		args, err := SplitCommand(cfg.HealthCheck.Target, lookupEnv(env))
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return errors.New("empty health check command")
+		}
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		if err := t.setCmdSysProcAttr(cmd, cfg); err != nil {
+			return err
+		}
+		cmd.Env = env
+		cmd.Dir = cfg.WorkingDirectory
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+		return cmd.Run()
+	}
+	return fmt.Errorf("unknown health check type '%s'", cfg.HealthCheck.Type)
+}
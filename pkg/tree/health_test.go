@@ -0,0 +1,93 @@
+package tree_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+func startTree(t *testing.T, treeImpl *tree.TreeImpl) {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+	t.Cleanup(func() {
+		treeImpl.Stop(context.Background())
+		<-errChan
+	})
+}
+
+func treeHealth(t *testing.T, treeImpl *tree.TreeImpl) tree.Health {
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	return status.Health
+}
+
+func TestHealthCheckHTTP(t *testing.T) {
+	var healthy atomic.Bool
+	healthy.Store(true)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Web\nCommand sleep 30\nHealthCheck http "+server.URL+"\nHealthCheckInterval 50ms\nHealthCheckThreshold 2\n"))
+	noErr(t, err)
+	startTree(t, treeImpl)
+
+	time.Sleep(150 * time.Millisecond)
+	if health := treeHealth(t, treeImpl); health != tree.Healthy {
+		t.Errorf("expected healthy tree, got '%s'", health)
+	}
+
+	healthy.Store(false)
+	time.Sleep(200 * time.Millisecond)
+	if health := treeHealth(t, treeImpl); health != tree.Unhealthy {
+		t.Errorf("expected unhealthy tree, got '%s'", health)
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	noErr(t, err)
+	defer ln.Close()
+
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Socket\nCommand sleep 30\nHealthCheck tcp "+ln.Addr().String()+"\nHealthCheckInterval 50ms\nHealthCheckThreshold 1\n"))
+	noErr(t, err)
+	startTree(t, treeImpl)
+
+	time.Sleep(150 * time.Millisecond)
+	if health := treeHealth(t, treeImpl); health != tree.Healthy {
+		t.Errorf("expected healthy tree, got '%s'", health)
+	}
+
+	ln.Close()
+	time.Sleep(150 * time.Millisecond)
+	if health := treeHealth(t, treeImpl); health != tree.Unhealthy {
+		t.Errorf("expected unhealthy tree, got '%s'", health)
+	}
+}
+
+func TestHealthCheckExecRestart(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Wedged\nCommand sleep 30\nHealthCheck exec sh -c 'exit 1'\nHealthCheckInterval 50ms\nHealthCheckThreshold 2\nHealthCheckRestart yes\nRestartDelay 10ms\n"))
+	noErr(t, err)
+	startTree(t, treeImpl)
+
+	time.Sleep(400 * time.Millisecond)
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.RunCount < 2 {
+		t.Errorf("unhealthy tree was not restarted: runs=%d", status.RunCount)
+	}
+	if status.ExitReason != tree.UnhealthyReason {
+		t.Errorf("unexpected exit reason: %s", status.ExitReason)
+	}
+}
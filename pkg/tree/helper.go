@@ -0,0 +1,117 @@
+package tree
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// helperEnv holds the helperOptions for a process that pine started by
+// executing itself, so that it can finish setting up the tree's process
+// before executing the tree's command.
+const helperEnv = "_PINE_EXEC_HELPER"
+
+// helperOptions is the setup the exec helper does before executing a tree's
+// command.
+type helperOptions struct {
+	WatchdogPid bool                `json:"watchdogPid,omitempty"`
+	UMask       *int                `json:"umask,omitempty"`
+	Limits      []Limit             `json:"limits,omitempty"`
+	Credential  *syscall.Credential `json:"credential,omitempty"`
+	Cgroup      string              `json:"cgroup,omitempty"`
+}
+
+func (o helperOptions) needed() bool {
+	return o.WatchdogPid || o.UMask != nil || len(o.Limits) > 0 || len(o.Cgroup) > 0
+}
+
+func init() {
+	if value, ok := os.LookupEnv(helperEnv); ok {
+		runHelper(value)
+	}
+}
+
+// helperCommand wraps argv to run through the exec helper with opts and env.
+// The command is resolved using pine's PATH, as it would be without the
+// helper. A command path with a slash is left to the helper, as it may be
+// relative to the tree's working directory.
+func helperCommand(args []string, env []string, opts helperOptions) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	path := args[0]
+	if !strings.Contains(path, "/") {
+		if path, err = exec.LookPath(path); err != nil {
+			return nil, err
+		}
+	}
+	encoded, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd := exec.Command(self, append([]string{path}, args...)...)
+	cmd.Env = append(slices.Clip(env), helperEnv+"="+string(encoded))
+	return cmd, nil
+}
+
+// runHelper applies the options and replaces the process with the tree's
+// command. It never returns.
+func runHelper(value string) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "pine: %v\n", err)
+		os.Exit(127)
+	}
+
+	var opts helperOptions
+	if err := json.Unmarshal([]byte(value), &opts); err != nil {
+		fail(fmt.Errorf("invalid helper options: %w", err))
+	}
+	if len(os.Args) < 3 {
+		fail(fmt.Errorf("missing command"))
+	}
+	os.Unsetenv(helperEnv)
+
+	// the tree's processes are only forked once it is in its cgroup
+	if len(opts.Cgroup) > 0 {
+		if err := writeCgroupFile(opts.Cgroup, "cgroup.procs", strconv.Itoa(os.Getpid())); err != nil {
+			fail(fmt.Errorf("failed to join cgroup: %w", err))
+		}
+	}
+	if opts.WatchdogPid {
+		os.Setenv("WATCHDOG_PID", strconv.Itoa(os.Getpid()))
+	}
+	if opts.UMask != nil {
+		syscall.Umask(*opts.UMask)
+	}
+	if err := setLimits(opts.Limits); err != nil {
+		fail(err)
+	}
+	if cred := opts.Credential; cred != nil {
+		groups := []int{}
+		for _, gid := range cred.Groups {
+			groups = append(groups, int(gid))
+		}
+		if err := syscall.Setgroups(groups); err != nil {
+			fail(fmt.Errorf("failed to set groups: %w", err))
+		}
+		if err := syscall.Setgid(int(cred.Gid)); err != nil {
+			fail(fmt.Errorf("failed to set group: %w", err))
+		}
+		if err := syscall.Setuid(int(cred.Uid)); err != nil {
+			fail(fmt.Errorf("failed to set user: %w", err))
+		}
+	}
+
+	if err := syscall.Exec(os.Args[1], os.Args[2:], os.Environ()); err != nil {
+		fail(err)
+	}
+}
@@ -0,0 +1,134 @@
+package tree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// holderEnv marks a process that pine started by executing itself to hold
+// the read ends of a tree's output pipes.
+const holderEnv = "_PINE_OUTPUT_HOLDER"
+
+// holderName is the argv[0] of a holder, followed by the pid and start time of
+// the tree it holds the output of.
+const holderName = "pine-output"
+
+// outputFd is the first descriptor of the output pipes in a holder, for stdout
+// and then stderr.
+const outputFd = 3
+
+func init() {
+	if _, ok := os.LookupEnv(holderEnv); ok {
+		runHolder()
+	}
+}
+
+// startHolder starts a process that holds the read ends of the output pipes
+// of the tree running as pid, so that the tree can keep writing while pine
+// restarts and the next pine can reopen them. The tree itself never sees the
+// read ends.
+func startHolder(pid int, pipes []*os.File) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	startTime, err := ProcessStartTime(pid)
+	if err != nil {
+		return err
+	}
+	cmd := &exec.Cmd{
+		Path:       self,
+		Args:       holderArgs(pid, startTime),
+		Env:        []string{holderEnv + "=1"},
+		Dir:        "/",
+		ExtraFiles: pipes,
+		// not in the tree's process group, so that stopping the tree leaves it be
+		SysProcAttr: &syscall.SysProcAttr{Setpgid: true},
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	go cmd.Wait()
+	return nil
+}
+
+func holderArgs(pid int, startTime uint64) []string {
+	return []string{holderName, strconv.Itoa(pid), strconv.FormatUint(startTime, 10)}
+}
+
+// runHolder waits until every writer of both pipes is gone, without reading
+// from them. It never returns.
+func runHolder() {
+	fds := []unix.PollFd{{Fd: outputFd}, {Fd: outputFd + 1}}
+	open := len(fds)
+	for open > 0 {
+		if _, err := unix.Poll(fds, -1); errors.Is(err, unix.EINTR) {
+			continue
+		} else if err != nil {
+			os.Exit(1)
+		}
+		for i := range fds {
+			if fds[i].Fd >= 0 && fds[i].Revents&(unix.POLLHUP|unix.POLLERR|unix.POLLNVAL) != 0 {
+				fds[i].Fd = -1
+				open--
+			}
+		}
+	}
+	os.Exit(0)
+}
+
+// findHolder returns the pid of the holder of the tree's output, for the tree
+// running as pid since startTime.
+func findHolder(pid int, startTime uint64) (int, error) {
+	want := []byte(strings.Join(holderArgs(pid, startTime), "\x00") + "\x00")
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		holder, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		cmdline, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "cmdline"))
+		if err == nil && bytes.Equal(cmdline, want) {
+			return holder, nil
+		}
+	}
+	return 0, fmt.Errorf("no process holds the output of process %d", pid)
+}
+
+// reopenOutput opens the read ends of the output pipes held by the holder
+// running as pid.
+func reopenOutput(pid int) ([]*os.File, error) {
+	pipes := []*os.File{}
+	for fd := outputFd; fd < outputFd+2; fd++ {
+		path := filepath.Join("/proc", strconv.Itoa(pid), "fd", strconv.Itoa(fd))
+		link, err := os.Readlink(path)
+		if err == nil && !strings.HasPrefix(link, "pipe:") {
+			err = fmt.Errorf("descriptor %d is %s, not an output pipe", fd, link)
+		}
+		var pipe *os.File
+		if err == nil {
+			// without O_NONBLOCK opening the pipe blocks if the writers just exited
+			pipe, err = os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+		}
+		if err != nil {
+			for _, p := range pipes {
+				p.Close()
+			}
+			return nil, err
+		}
+		pipes = append(pipes, pipe)
+	}
+	return pipes, nil
+}
@@ -0,0 +1,117 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// limitResources are the resources of the Limit directives, e.g. LimitNOFILE.
+var limitResources = map[string]int{
+	"CPU":        unix.RLIMIT_CPU,
+	"FSIZE":      unix.RLIMIT_FSIZE,
+	"DATA":       unix.RLIMIT_DATA,
+	"STACK":      unix.RLIMIT_STACK,
+	"CORE":       unix.RLIMIT_CORE,
+	"RSS":        unix.RLIMIT_RSS,
+	"NOFILE":     unix.RLIMIT_NOFILE,
+	"AS":         unix.RLIMIT_AS,
+	"NPROC":      unix.RLIMIT_NPROC,
+	"MEMLOCK":    unix.RLIMIT_MEMLOCK,
+	"LOCKS":      unix.RLIMIT_LOCKS,
+	"SIGPENDING": unix.RLIMIT_SIGPENDING,
+	"MSGQUEUE":   unix.RLIMIT_MSGQUEUE,
+	"NICE":       unix.RLIMIT_NICE,
+	"RTPRIO":     unix.RLIMIT_RTPRIO,
+	"RTTIME":     unix.RLIMIT_RTTIME,
+}
+
+// Limit is a resource limit of a tree. Resource is the name of its directive
+// without the Limit prefix, e.g. NOFILE.
+type Limit struct {
+	Resource string
+	Soft     uint64
+	Hard     uint64
+}
+
+// String formats the limit as it is configured, soft:hard or a single value
+// if both are the same.
+func (l Limit) String() string {
+	if l.Soft == l.Hard {
+		return formatLimitValue(l.Soft)
+	}
+	return formatLimitValue(l.Soft) + ":" + formatLimitValue(l.Hard)
+}
+
+func formatLimitValue(value uint64) string {
+	if value == unix.RLIM_INFINITY {
+		return "infinity"
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// parseLimit parses a limit of the form "value" or "soft:hard", where each
+// value is a size or "infinity".
+func parseLimit(resource string, value string) (Limit, error) {
+	limit := Limit{Resource: resource}
+	soft, hard, found := strings.Cut(value, ":")
+	var err error
+	if limit.Soft, err = parseLimitValue(soft); err != nil {
+		return limit, err
+	}
+	limit.Hard = limit.Soft
+	if found {
+		if limit.Hard, err = parseLimitValue(hard); err != nil {
+			return limit, err
+		}
+	}
+	return limit, nil
+}
+
+func parseLimitValue(value string) (uint64, error) {
+	if value == "infinity" {
+		return unix.RLIM_INFINITY, nil
+	}
+	size, err := parseSize(value)
+	return uint64(size), err
+}
+
+// validateLimits checks that no soft limit is above its hard limit.
+func validateLimits(limits []Limit) error {
+	for _, limit := range limits {
+		if limit.Soft > limit.Hard {
+			return fmt.Errorf("invalid Limit%s: soft limit %s is above the hard limit %s",
+				limit.Resource, formatLimitValue(limit.Soft), formatLimitValue(limit.Hard))
+		}
+	}
+	return nil
+}
+
+// setLimits sets the limits of the calling process.
+func setLimits(limits []Limit) error {
+	for _, limit := range limits {
+		rlimit := unix.Rlimit{Cur: limit.Soft, Max: limit.Hard}
+		if err := unix.Setrlimit(limitResources[limit.Resource], &rlimit); err != nil {
+			return fmt.Errorf("failed to set Limit%s=%s: %w", limit.Resource, limit, err)
+		}
+	}
+	return nil
+}
+
+// processLimits returns the limits of pid for the resources in limits.
+func processLimits(pid int, limits []Limit) ([]Limit, error) {
+	effective := []Limit{}
+	var err error
+	for _, limit := range limits {
+		var rlimit unix.Rlimit
+		if e := unix.Prlimit(pid, limitResources[limit.Resource], nil, &rlimit); e != nil {
+			err = errors.Join(err, e)
+			continue
+		}
+		effective = append(effective, Limit{Resource: limit.Resource, Soft: rlimit.Cur, Hard: rlimit.Max})
+	}
+	return effective, err
+}
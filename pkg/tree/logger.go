@@ -1,11 +1,14 @@
 package tree
 
 import (
+	"cmp"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -13,18 +16,42 @@ import (
 
 const (
 	logFileTimestampLayout = "20060102-150405"
+	logMarkInterval        = time.Second
 )
 
+// LogRotation decides when a log file is rotated and which of the rotated
+// files are kept. Zero limits are unlimited.
+type LogRotation struct {
+	MaxAge       time.Duration // of rotated files
+	MaxSize      int64         // of the live file
+	MaxFiles     int           // rotated files
+	MaxTotalSize int64         // of the live and rotated files
+	Compress     Compression   // of rotated files
+}
+
 type RotatingFileWriter struct {
-	mu     sync.Mutex
-	file   *os.File
-	path   string
-	maxAge time.Duration
+	mu       sync.Mutex
+	file     *os.File
+	path     string
+	rotation LogRotation
+	size     int64
+	marks    []logMark
+
+	// rotated files are compressed in the background, one pass at a time
+	compressMu  sync.Mutex
+	compressing sync.WaitGroup
+}
+
+// logMark records where the output written at a time starts in the log file.
+// A mark is kept at most once per logMarkInterval.
+type logMark struct {
+	at     time.Time
+	offset int64
 }
 
 var _ io.WriteCloser = (*RotatingFileWriter)(nil)
 
-func NewRotatingFileWriter(path string, maxAge int) (*RotatingFileWriter, error) {
+func NewRotatingFileWriter(path string, rotation LogRotation) (*RotatingFileWriter, error) {
 	if stat, err := os.Stat(path); err == nil && stat.Size() > 0 {
 		rotated := stampedFilename(path)
 		if err := os.Rename(path, rotated); err != nil {
@@ -35,94 +62,276 @@ func NewRotatingFileWriter(path string, maxAge int) (*RotatingFileWriter, error)
 	if err != nil {
 		return nil, err
 	}
-	maxAgeDur := time.Duration(maxAge*24) * time.Hour
-	if err := removeOldFiles(path, maxAgeDur); err != nil {
-		slog.Error("could not remove old logs", "log", path, "err", err)
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
 	}
 
-	return &RotatingFileWriter{
-		file:   f,
-		path:   path,
-		maxAge: maxAgeDur,
-	}, nil
+	w := &RotatingFileWriter{
+		file:     f,
+		path:     path,
+		rotation: rotation,
+		size:     stat.Size(),
+	}
+	w.removeOldFiles()
+	return w, nil
 }
 
+// Write appends p to the log file, first rotating it if p would grow it past
+// its maximum size. Output is written line by line, so lines are not split
+// between files.
 func (w *RotatingFileWriter) Write(p []byte) (int, error) {
 	w.mu.Lock()
 	defer w.mu.Unlock()
-	return w.file.Write(p)
+	if w.rotation.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.rotation.MaxSize {
+		if err := w.rotate(); err != nil {
+			slog.Warn("failed to rotate log file", "log", w.path, "err", err)
+		}
+	}
+	now := time.Now()
+	if len(w.marks) == 0 || now.Sub(w.marks[len(w.marks)-1].at) >= logMarkInterval {
+		w.marks = append(w.marks, logMark{at: now, offset: w.size})
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
 }
 
+// offsetSince returns the offset in the log file of the output written since
+// t. It may include up to logMarkInterval of earlier output.
+func (w *RotatingFileWriter) offsetSince(t time.Time) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	i, _ := slices.BinarySearchFunc(w.marks, t, func(mark logMark, t time.Time) int {
+		return mark.at.Add(logMarkInterval).Compare(t)
+	})
+	if i < len(w.marks) {
+		return w.marks[i].offset
+	}
+	return w.size
+}
+
+// Close closes the log file and waits for rotated files to be compressed.
 func (w *RotatingFileWriter) Close() error {
-	return w.file.Close()
+	err := w.file.Close()
+	w.compressing.Wait()
+	return err
 }
 
 func (w *RotatingFileWriter) Rotate() error {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.rotate()
+}
 
-	if err := w.file.Close(); err != nil {
-		return err
-	}
-
+// rotate moves the log file aside and starts a new one. The old file is only
+// closed once the new one is open, so that no write is lost if opening it
+// fails. The caller must hold mu.
+func (w *RotatingFileWriter) rotate() error {
 	rotated := stampedFilename(w.path)
 	if err := os.Rename(w.path, rotated); err != nil {
 		return err
 	}
-
-	if err := removeOldFiles(w.path, w.maxAge); err != nil {
-		slog.Error("could not remove old logs", "log", w.path, "err", err)
-	}
-
 	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
-
+	w.file.Close()
 	w.file = f
+	w.size = 0
+	w.marks = nil
+
+	w.removeOldFiles()
 	return nil
 }
 
+// removeOldFiles removes the rotated files the writer no longer keeps. If they
+// are compressed, they are removed in the background once the uncompressed ones
+// are compressed. The caller must hold mu or own w.
+func (w *RotatingFileWriter) removeOldFiles() {
+	if w.rotation.Compress.ext() == "" {
+		if err := removeOldFiles(w.path, w.rotation, w.size); err != nil {
+			slog.Error("could not remove old logs", "log", w.path, "err", err)
+		}
+		return
+	}
+	w.compressing.Go(func() {
+		w.compressMu.Lock()
+		defer w.compressMu.Unlock()
+		rotated, err := rotatedLogFiles(w.path)
+		if err != nil {
+			slog.Error("could not list old logs", "log", w.path, "err", err)
+			return
+		}
+		for _, file := range rotated {
+			if file.compress != NoCompression {
+				continue
+			}
+			if err := compressFile(file.filename, w.rotation.Compress); err != nil {
+				slog.Warn("failed to compress log file", "filename", file.filename, "err", err)
+			}
+		}
+		w.mu.Lock()
+		size := w.size
+		w.mu.Unlock()
+		if err := removeOldFiles(w.path, w.rotation, size); err != nil {
+			slog.Error("could not remove old logs", "log", w.path, "err", err)
+		}
+	})
+}
+
+// stampedFilename returns the name for the log file rotated now. Files rotated
+// within the same second get increasing sequence numbers, so that the names
+// keep their order even after older files are removed.
 func stampedFilename(filename string) string {
-	return filename + "." + time.Now().Format(logFileTimestampLayout)
+	stamped := filename + "." + time.Now().Format(logFileTimestampLayout)
+	rotated, _ := rotatedLogFiles(filename)
+	seq := -1
+	for _, file := range rotated {
+		if file.filename == stamped || strings.HasPrefix(file.filename, stamped+".") {
+			seq = max(seq, file.seq)
+		}
+	}
+	if seq < 0 {
+		return stamped
+	}
+	return stamped + "." + strconv.Itoa(seq+1)
 }
 
-func removeOldFiles(path string, maxAge time.Duration) error {
-	filenames, err := filepath.Glob(path + "*.*")
+// rotatedLog is a rotated file of a log, named path.STAMP or path.STAMP.SEQ,
+// followed by the extension of its compression, if any.
+type rotatedLog struct {
+	filename string
+	stamp    time.Time
+	seq      int
+	compress Compression
+}
+
+func parseRotatedLog(path string, filename string) (rotatedLog, bool) {
+	rest, ok := strings.CutPrefix(filename, path+".")
+	if !ok {
+		return rotatedLog{}, false
+	}
+	file := rotatedLog{filename: filename, compress: NoCompression}
+	for _, c := range compressions {
+		if trimmed, ok := strings.CutSuffix(rest, c.ext()); ok {
+			rest = trimmed
+			file.compress = c
+			break
+		}
+	}
+	if len(rest) < len(logFileTimestampLayout) {
+		return rotatedLog{}, false
+	}
+	stamp, err := time.ParseInLocation(logFileTimestampLayout, rest[:len(logFileTimestampLayout)], time.Local)
 	if err != nil {
-		return err
+		return rotatedLog{}, false
 	}
+	file.stamp = stamp
+	if rest = rest[len(logFileTimestampLayout):]; len(rest) > 0 {
+		seq, ok := strings.CutPrefix(rest, ".")
+		if file.seq, err = strconv.Atoi(seq); !ok || err != nil || file.seq < 1 {
+			return rotatedLog{}, false
+		}
+	}
+	return file, true
+}
 
+// rotatedLogFiles returns the rotated files of the log at path, oldest first.
+// A file that is being compressed is only returned uncompressed.
+func rotatedLogFiles(path string) ([]rotatedLog, error) {
+	filenames, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	rotated := []rotatedLog{}
 	for _, filename := range filenames {
-		stat, err := os.Stat(filename)
-		if err != nil {
-			return err
+		if file, ok := parseRotatedLog(path, filename); ok {
+			rotated = append(rotated, file)
 		}
-		if stat.IsDir() {
-			continue
+	}
+	slices.SortFunc(rotated, func(a, b rotatedLog) int {
+		if c := cmp.Or(a.stamp.Compare(b.stamp), cmp.Compare(a.seq, b.seq)); c != 0 {
+			return c
 		}
-		if stat.Size() == 0 {
-			if err := os.Remove(filename); err != nil {
-				slog.Warn("failed to remove empty log file", "filename", filename, "err", err)
-			} else {
-				slog.Info("removed empty log file", "filename", filename)
-			}
-			continue
+		switch {
+		case a.compress == b.compress:
+			return 0
+		case a.compress == NoCompression:
+			return -1
 		}
-		stamp := strings.TrimPrefix(filepath.Ext(filename), ".")
-		ts, err := time.Parse(logFileTimestampLayout, stamp)
+		return 1
+	})
+	rotated = slices.CompactFunc(rotated, func(a, b rotatedLog) bool {
+		return a.stamp.Equal(b.stamp) && a.seq == b.seq
+	})
+	return rotated, nil
+}
+
+// removeOldFiles removes the rotated files of the log at path that are empty
+// or that rotation no longer keeps, oldest first, and the leftovers of
+// interrupted compressions. liveSize is the size of the live log file, which
+// counts toward the total size.
+func removeOldFiles(path string, rotation LogRotation, liveSize int64) error {
+	removeStaleCompressions(path)
+	rotated, err := rotatedLogFiles(path)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	kept := 0
+	total := liveSize
+	full := false // once a file does not fit, older ones do not either
+	for _, file := range slices.Backward(rotated) {
+		stat, err := os.Stat(file.filename)
 		if err != nil {
-			slog.Warn("ignoring file with invalid timestamp", "filename", filename, "stamp", stamp)
+			return err
+		}
+		var reason string
+		switch {
+		case stat.Size() == 0:
+			reason = "empty"
+		case rotation.MaxAge > 0 && file.stamp.Add(rotation.MaxAge).Before(now):
+			reason = "too old"
+		case rotation.MaxFiles > 0 && kept >= rotation.MaxFiles:
+			reason = "too many files"
+		case full || (rotation.MaxTotalSize > 0 && total+stat.Size() > rotation.MaxTotalSize):
+			reason = "total size too large"
+			full = true
+		default:
+			kept++
+			total += stat.Size()
 			continue
 		}
-		if ts.Add(maxAge).Before(time.Now()) {
-			if err := os.Remove(filename); err != nil {
-				slog.Warn("failed to remove old log file", "filename", filename, "err", err)
-			} else {
-				slog.Info("removed old log file", "filename", filename)
-			}
+		if err := os.Remove(file.filename); err != nil {
+			slog.Warn("failed to remove old log file", "filename", file.filename, "err", err)
+		} else {
+			slog.Info("removed old log file", "filename", file.filename, "reason", reason)
 		}
 	}
 
 	return nil
 }
+
+// removeStaleCompressions removes the temporary files of compressions that
+// were interrupted, e.g. by pine crashing. The caller must ensure that none of
+// the log's files are being compressed.
+func removeStaleCompressions(path string) {
+	filenames, err := filepath.Glob(path + ".*.tmp")
+	if err != nil {
+		return
+	}
+	for _, filename := range filenames {
+		file, ok := parseRotatedLog(path, strings.TrimSuffix(filename, ".tmp"))
+		if !ok || file.compress == NoCompression {
+			continue
+		}
+		if err := os.Remove(filename); err != nil {
+			slog.Warn("failed to remove interrupted compression", "filename", filename, "err", err)
+		} else {
+			slog.Info("removed interrupted compression", "filename", filename)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package tree_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+// writeLogLines writes count numbered lines to a log at path and returns the
+// lines kept in all of its files, in no particular order.
+func writeLogLines(t *testing.T, path string, rotation tree.LogRotation, count int) ([]string, map[string]int64) {
+	w, err := tree.NewRotatingFileWriter(path, rotation)
+	noErr(t, err)
+	for i := range count {
+		_, err := fmt.Fprintf(w, "line %03d\n", i)
+		noErr(t, err)
+	}
+	noErr(t, w.Close())
+
+	filenames, err := filepath.Glob(path + "*")
+	noErr(t, err)
+	lines := []string{}
+	sizes := map[string]int64{}
+	for _, filename := range filenames {
+		data, err := os.ReadFile(filename)
+		noErr(t, err)
+		lines = append(lines, strings.Fields(strings.ReplaceAll(string(data), "line ", "line-"))...)
+		sizes[filename] = int64(len(data))
+	}
+	slices.Sort(lines)
+	return lines, sizes
+}
+
+func TestRotatingFileWriterMaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	lines, sizes := writeLogLines(t, path, tree.LogRotation{MaxSize: 100, MaxFiles: 3}, 100)
+
+	if len(sizes) != 4 {
+		t.Errorf("expected the live and 3 rotated files, got %v", sizes)
+	}
+	for filename, size := range sizes {
+		if size > 100 {
+			t.Errorf("%s is larger than the maximum size: %d", filename, size)
+		}
+	}
+	// the kept lines are the last ones, without gaps or duplicates
+	for i, line := range lines {
+		if want := fmt.Sprintf("line-%03d", 100-len(lines)+i); line != want {
+			t.Fatalf("expected %s, got %s in %v", want, line, lines)
+		}
+	}
+}
+
+func TestRotatingFileWriterMaxTotalSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	_, sizes := writeLogLines(t, path, tree.LogRotation{MaxSize: 90, MaxTotalSize: 250}, 100)
+
+	var rotated int64
+	for filename, size := range sizes {
+		if filename != path {
+			rotated += size
+		}
+	}
+	if rotated == 0 || rotated > 250 {
+		t.Errorf("unexpected total size of rotated files: %d", rotated)
+	}
+}
+
+func TestRotatingFileWriterCompress(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	// left behind by a compression that was interrupted
+	noErr(t, os.WriteFile(path+".20200101-000000.gz.tmp", []byte("partial"), 0644))
+	w, err := tree.NewRotatingFileWriter(path, tree.LogRotation{MaxSize: 100, Compress: tree.GzipCompression})
+	noErr(t, err)
+	for i := range 30 {
+		_, err := fmt.Fprintf(w, "line %03d\n", i)
+		noErr(t, err)
+	}
+	noErr(t, w.Close())
+
+	filenames, err := filepath.Glob(path + ".*")
+	noErr(t, err)
+	if len(filenames) != 2 {
+		t.Fatalf("expected 2 rotated files, got %v", filenames)
+	}
+	for _, filename := range filenames {
+		if !strings.HasSuffix(filename, ".gz") {
+			t.Errorf("rotated file is not compressed: %s", filename)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package tree
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// followBuffer is how many writes of output a follower can fall behind before
+// it is dropped, so that a slow client never blocks the tree.
+const followBuffer = 256
+
+// LogOptions selects the output of a tree returned by Logs.
+type LogOptions struct {
+	Lines  int       // only the last lines, or all output if 0
+	Since  time.Time // only output written since, if set
+	Follow bool      // keep reading new output until the context is done
+}
+
+// Logs returns the output of the tree kept in its log files, including the
+// rotated ones. With opts.Follow the reader continues with new output, across
+// rotations and restarts, until ctx is done.
+func (t *TreeImpl) Logs(ctx context.Context, opts LogOptions) (io.ReadCloser, error) {
+	cfg := t.Config()
+
+	// Holding outputMu keeps the tree from writing until the files are open,
+	// which fixes where the history ends, and the follower is added, so no
+	// output is lost or repeated. The history is only read after, as the tree
+	// needs outputMu for every write.
+	t.outputMu.Lock()
+	t.stateMu.Lock()
+	var logger *RotatingFileWriter
+	if t.runOutput != nil {
+		logger = t.runOutput.file(cfg.LogFile)
+	}
+	t.stateMu.Unlock()
+
+	sections, err := openLogSections(cfg.LogFile, opts.Since, logger)
+	if err != nil {
+		t.outputMu.Unlock()
+		return nil, err
+	}
+	r := &logReader{ctx: ctx}
+	if opts.Follow {
+		follower := make(chan []byte, followBuffer)
+		if t.followers == nil {
+			t.followers = map[chan []byte]bool{}
+		}
+		t.followers[follower] = true
+		r.live = follower
+		r.unfollow = func() {
+			t.outputMu.Lock()
+			defer t.outputMu.Unlock()
+			delete(t.followers, follower)
+		}
+	}
+	t.outputMu.Unlock()
+
+	if opts.Lines > 0 {
+		if sections, err = tailSections(sections, opts.Lines); err != nil {
+			closeSections(sections)
+			r.Close()
+			return nil, err
+		}
+	}
+	for i := range sections {
+		if err := sections[i].decompress(); err != nil {
+			closeSections(sections)
+			r.Close()
+			return nil, err
+		}
+	}
+
+	readers := []io.Reader{}
+	for _, section := range sections {
+		readers = append(readers, io.NewSectionReader(section.file, section.start, section.end-section.start))
+	}
+	r.history = io.MultiReader(readers...)
+	r.sections = sections
+	return r, nil
+}
+
+// logSection is the part of a log file to read. A compressed file is only
+// decompressed when it is read.
+type logSection struct {
+	file       *os.File
+	compress   Compression
+	start, end int64
+}
+
+// decompress replaces the compressed file of the section with its contents.
+func (s *logSection) decompress() error {
+	if s.compress == NoCompression {
+		return nil
+	}
+	f, size, err := decompressFile(s.file, s.compress)
+	if err != nil {
+		return err
+	}
+	s.file.Close()
+	s.file = f
+	s.compress = NoCompression
+	s.end = size
+	return nil
+}
+
+// openLogSections opens the log files at path, oldest first, skipping the
+// output written before since. Only the live log file has marks to find where
+// since starts in it, rotated files are skipped as a whole.
+func openLogSections(path string, since time.Time, logger *RotatingFileWriter) ([]logSection, error) {
+	files, err := rotatedLogFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, rotatedLog{filename: path, compress: NoCompression})
+
+	sections := []logSection{}
+	for _, file := range files {
+		f, err := os.Open(file.filename)
+		if errors.Is(err, os.ErrNotExist) {
+			// compressed or removed since listing it
+			if f, file = openCompressed(file); f == nil {
+				continue
+			}
+		} else if err != nil {
+			closeSections(sections)
+			return nil, err
+		}
+		stat, err := f.Stat()
+		if err != nil {
+			f.Close()
+			closeSections(sections)
+			return nil, err
+		}
+		section := logSection{file: f, compress: file.compress, end: stat.Size()}
+		if !since.IsZero() {
+			if stat.ModTime().Before(since) {
+				f.Close()
+				continue
+			}
+			if file.filename == path && logger != nil {
+				section.start = min(logger.offsetSince(since), section.end)
+			}
+		}
+		sections = append(sections, section)
+	}
+	return sections, nil
+}
+
+// openCompressed opens the compressed copy of an uncompressed rotated file, if
+// there is one.
+func openCompressed(file rotatedLog) (*os.File, rotatedLog) {
+	if file.compress != NoCompression {
+		return nil, file
+	}
+	for _, c := range compressions {
+		if f, err := os.Open(file.filename + c.ext()); err == nil {
+			file.filename += c.ext()
+			file.compress = c
+			return f, file
+		}
+	}
+	return nil, file
+}
+
+// tailSections trims sections to their last n lines, decompressing the ones it
+// reads.
+func tailSections(sections []logSection, n int) ([]logSection, error) {
+	buf := make([]byte, 32*1024)
+	last := true
+	count := 0
+	for i := len(sections) - 1; i >= 0; i-- {
+		section := &sections[i]
+		if err := section.decompress(); err != nil {
+			return sections, err
+		}
+		pos := section.end
+		for pos > section.start {
+			size := min(int64(len(buf)), pos-section.start)
+			pos -= size
+			if _, err := section.file.ReadAt(buf[:size], pos); err != nil {
+				return sections, err
+			}
+			for j := size - 1; j >= 0; j-- {
+				if buf[j] != '\n' {
+					last = false
+					continue
+				} else if last {
+					// the newline ending the output does not start a line
+					last = false
+					continue
+				}
+				count++
+				if count == n {
+					section.start = pos + j + 1
+					closeSections(sections[:i])
+					return sections[i:], nil
+				}
+			}
+		}
+	}
+	return sections, nil
+}
+
+func closeSections(sections []logSection) {
+	for _, section := range sections {
+		section.file.Close()
+	}
+}
+
+// logReader reads the output kept in the log files, then the output written
+// after, if it follows the tree.
+type logReader struct {
+	ctx      context.Context
+	history  io.Reader
+	sections []logSection
+	live     chan []byte
+	pending  []byte
+	unfollow func()
+}
+
+func (r *logReader) Read(p []byte) (int, error) {
+	if r.history != nil {
+		n, err := r.history.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		r.history = nil
+		closeSections(r.sections)
+		r.sections = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	if r.live == nil {
+		return 0, io.EOF
+	}
+
+	if len(r.pending) == 0 {
+		select {
+		case data, ok := <-r.live:
+			if !ok {
+				return 0, errors.New("fell too far behind the tree output")
+			}
+			r.pending = data
+		case <-r.ctx.Done():
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *logReader) Close() error {
+	closeSections(r.sections)
+	r.sections = nil
+	if r.unfollow != nil {
+		r.unfollow()
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package tree_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+func TestLogsLines(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Logs\nShell yes\nCommand for i in 1 2 3 4 5; do echo line $i; done; sleep 30\n"))
+	noErr(t, err)
+	go treeImpl.Start(context.Background())
+	defer treeImpl.Stop(context.Background())
+	time.Sleep(300 * time.Millisecond)
+
+	for _, tc := range []struct {
+		opts tree.LogOptions
+		want string
+	}{
+		{tree.LogOptions{Lines: 2}, "line 4\nline 5\n"},
+		{tree.LogOptions{Lines: 10}, "line 1\nline 2\nline 3\nline 4\nline 5\n"},
+		{tree.LogOptions{Since: time.Now().Add(time.Minute)}, ""},
+	} {
+		logs, err := treeImpl.Logs(context.Background(), tc.opts)
+		noErr(t, err)
+		output, err := io.ReadAll(logs)
+		noErr(t, err)
+		logs.Close()
+		if string(output) != tc.want {
+			t.Errorf("%+v: unexpected logs %q", tc.opts, output)
+		}
+	}
+}
+
+func TestLogsFollow(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Logs\nShell yes\nCommand i=0; while true; do i=$((i+1)); echo line $i; sleep 0.05; done\n"))
+	noErr(t, err)
+	go treeImpl.Start(context.Background())
+	defer treeImpl.Stop(context.Background())
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	logs, err := treeImpl.Logs(ctx, tree.LogOptions{Lines: 1, Follow: true})
+	noErr(t, err)
+	defer logs.Close()
+	lines := make(chan []string, 1)
+	go func() {
+		read := []string{}
+		scanner := bufio.NewScanner(logs)
+		for scanner.Scan() {
+			read = append(read, scanner.Text())
+		}
+		lines <- read
+	}()
+
+	time.Sleep(300 * time.Millisecond)
+	noErr(t, treeImpl.RotateLog())
+	time.Sleep(300 * time.Millisecond)
+	cancel()
+
+	read := <-lines
+	if len(read) < 5 {
+		t.Fatalf("too few lines followed: %q", read)
+	}
+	var first int
+	fmt.Sscanf(read[0], "line %d", &first)
+	for i, line := range read {
+		if want := fmt.Sprintf("line %d", first+i); line != want {
+			t.Fatalf("expected %q, got %q in %q", want, line, read)
+		}
+	}
+}
+
+func TestLogsCompressed(t *testing.T) {
+	filename := createTreeFile(t, "Name Logs\nShell yes\nMaxLogSize 100\nLogCompress zstd\nCommand for i in $(seq 1 50); do echo line $i; done\n")
+	treeImpl, err := tree.NewTree(filename)
+	noErr(t, err)
+	noErr(t, treeImpl.Start(context.Background()))
+	// output is still copied for a moment after the tree exits
+	for range 200 {
+		if data, _ := os.ReadFile(filepath.Join(filepath.Dir(filename), "test.log")); strings.HasSuffix(string(data), "line 50\n") {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, tc := range []struct {
+		opts  tree.LogOptions
+		first int
+	}{
+		{tree.LogOptions{}, 1},
+		{tree.LogOptions{Lines: 25}, 26},
+	} {
+		logs, err := treeImpl.Logs(context.Background(), tc.opts)
+		noErr(t, err)
+		output, err := io.ReadAll(logs)
+		noErr(t, err)
+		logs.Close()
+		want := ""
+		for i := tc.first; i <= 50; i++ {
+			want += fmt.Sprintf("line %d\n", i)
+		}
+		if string(output) != want {
+			t.Errorf("%+v: unexpected logs %q", tc.opts, output)
+		}
+	}
+}
+
+func TestRecentOutput(t *testing.T) {
+	dir := t.TempDir()
+	currUser, err := user.Current()
+	noErr(t, err)
+	// the log file cannot be created below a regular file
+	notDir := filepath.Join(dir, "file")
+	noErr(t, os.WriteFile(notDir, nil, 0644))
+	filename := filepath.Join(dir, "test.tree")
+	noErr(t, os.WriteFile(filename, []byte("Name Crash\nShell yes\nOutputBufferLines 3\nUser "+currUser.Username+
+		"\nLogFile "+filepath.Join(notDir, "test.log")+"\nCommand for i in 1 2 3 4; do echo line $i; done; printf partial; exit 3\n"), 0644))
+	treeImpl, err := tree.NewTree(filename)
+	noErr(t, err)
+
+	err = treeImpl.Start(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "line 4 / partial") {
+		t.Errorf("error does not include the last output: %v", err)
+	}
+	want := []string{"line 3", "line 4", "partial"}
+	if output := treeImpl.RecentOutput(); !slices.Equal(output, want) {
+		t.Errorf("unexpected recent output: %q", output)
+	}
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if !slices.Equal(status.LastOutput, want) || status.ExitCode != 3 {
+		t.Errorf("unexpected status: output %q exit code %d", status.LastOutput, status.ExitCode)
+	}
+}
+
+func TestStandardStreams(t *testing.T) {
+	errLog := filepath.Join(t.TempDir(), "err.log")
+	filename := createTreeFile(t, "Name Streams\nShell yes\nLogTimestamps yes\nStandardError "+errLog+
+		"\nCommand echo out; echo err >&2; printf par; sleep 0.1; printf 'tial\\n'; printf end\n")
+	treeImpl, err := tree.NewTree(filename)
+	noErr(t, err)
+	noErr(t, treeImpl.Start(context.Background()))
+
+	for _, tc := range []struct {
+		filename string
+		want     []string
+	}{
+		{filepath.Join(filepath.Dir(filename), "test.log"), []string{"stdout: out", "stdout: partial", "stdout: end"}},
+		{errLog, []string{"stderr: err"}},
+	} {
+		data := readLog(t, tc.filename, len(tc.want))
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(lines) != len(tc.want) {
+			t.Fatalf("unexpected lines in %s: %q", tc.filename, lines)
+		}
+		for i, line := range lines {
+			stamp, rest, _ := strings.Cut(line, " ")
+			if _, err := time.Parse(time.RFC3339, stamp); err != nil || rest != tc.want[i] {
+				t.Errorf("expected %q with a timestamp, got %q", tc.want[i], line)
+			}
+		}
+	}
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	filename := createTreeFile(t, "Name JSON\nShell yes\nLogFormat json\n"+
+		`Command echo plain; echo '{"level":"info","n":1}'; echo oops >&2`+"\n")
+	treeImpl, err := tree.NewTree(filename)
+	noErr(t, err)
+	noErr(t, treeImpl.Start(context.Background()))
+
+	data := readLog(t, filepath.Join(filepath.Dir(filename), "test.log"), 3)
+	records := []map[string]any{}
+	for line := range strings.Lines(string(data)) {
+		record := map[string]any{}
+		noErr(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	if len(records) != 3 {
+		t.Fatalf("unexpected records: %q", data)
+	}
+	// the streams are copied concurrently
+	slices.SortStableFunc(records, func(a, b map[string]any) int {
+		return strings.Compare(a["stream"].(string), b["stream"].(string))
+	})
+	for i, want := range []struct {
+		stream  string
+		message any
+	}{
+		{"stderr", "oops"},
+		{"stdout", "plain"},
+		{"stdout", map[string]any{"level": "info", "n": 1.0}},
+	} {
+		record := records[i]
+		if record["tree"] != "JSON" || record["stream"] != want.stream || record["run"] != 1.0 || record["pid"] == 0.0 {
+			t.Errorf("unexpected record %v", record)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record["timestamp"].(string)); err != nil {
+			t.Errorf("unexpected timestamp: %v", err)
+		}
+		if fmt.Sprint(record["message"]) != fmt.Sprint(want.message) {
+			t.Errorf("expected message %v, got %v", want.message, record["message"])
+		}
+	}
+}
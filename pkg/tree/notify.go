@@ -0,0 +1,138 @@
+package tree
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var (
+	RuntimeDir = "/run/pine"
+)
+
+// notifySocket receives sd_notify style readiness messages from a tree. It
+// is exported to the tree as NOTIFY_SOCKET.
+type notifySocket struct {
+	conn *net.UnixConn
+	path string
+}
+
+func listenNotify(name string) (*notifySocket, error) {
+	if err := os.MkdirAll(RuntimeDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(RuntimeDir, strings.ReplaceAll(name, "/", "_")+".notify")
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	sock := &notifySocket{conn: conn, path: path}
+
+	// Trees may run as another user, so anyone may send to the socket. Senders
+	// are checked against the tree's processes using their credentials.
+	if err := os.Chmod(path, 0666); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err = errors.Join(err, sockErr); err != nil {
+		sock.Close()
+		return nil, err
+	}
+	return sock, nil
+}
+
+// serve reads messages until the socket is closed and passes the sender's pid
+// and the message's KEY=VALUE assignments to handle.
+func (n *notifySocket) serve(handle func(pid int, fields map[string]string)) {
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(syscall.SizeofUcred))
+	for {
+		size, oobn, _, _, err := n.conn.ReadMsgUnix(buf, oob)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Warn("failed to read notify socket", "path", n.path, "err", err)
+			}
+			return
+		}
+
+		pid := senderPid(oob[:oobn])
+		if pid <= 0 {
+			slog.Warn("ignoring notify message without credentials", "path", n.path)
+			continue
+		}
+		fields := map[string]string{}
+		for _, line := range strings.Split(string(buf[:size]), "\n") {
+			if key, value, ok := strings.Cut(line, "="); ok {
+				fields[key] = value
+			}
+		}
+		handle(pid, fields)
+	}
+}
+
+func (n *notifySocket) Close() error {
+	err := n.conn.Close()
+	if rmErr := os.Remove(n.path); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+		err = errors.Join(err, rmErr)
+	}
+	return err
+}
+
+func senderPid(oob []byte) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, msg := range msgs {
+		if cred, err := syscall.ParseUnixCredentials(&msg); err == nil {
+			return int(cred.Pid)
+		}
+	}
+	return 0
+}
+
+// handleNotify applies a message sent to the tree's notify socket. Only the
+// tree's own processes may change its state.
+func (t *TreeImpl) handleNotify(proc *process, cfg Config, sender int, fields map[string]string) {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	if t.pid == 0 || (sender != t.pid && processGroup(sender) != t.pgid) {
+		slog.Warn("ignoring notify message from foreign process", "name", cfg.Name, "pid", sender)
+		return
+	}
+
+	if status, ok := fields["STATUS"]; ok {
+		t.statusText = status
+	}
+	if fields["WATCHDOG"] == "1" {
+		select {
+		case proc.watchdog <- struct{}{}:
+		default:
+		}
+	}
+	if fields["READY"] == "1" && t.currState == StartingState {
+		slog.Info("tree is ready", "name", cfg.Name)
+		t.setState(RunningState)
+		proc.markReady()
+	}
+	if fields["STOPPING"] == "1" && t.currState != StoppingState {
+		slog.Info("tree is stopping", "name", cfg.Name)
+		t.setState(StoppingState)
+	}
+}
@@ -0,0 +1,159 @@
+package tree_test
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+// TestNotifyHelper is not a real test. It is run as a tree's command and sends
+// each argument after "--" to NOTIFY_SOCKET, with ";" separating the lines of
+// a message, and sleeps for "sleep=<duration>" arguments in between. A
+// "status-env=<name>" argument sends the variable's value as the status.
+func TestNotifyHelper(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	addr := &net.UnixAddr{Name: os.Getenv("NOTIFY_SOCKET"), Net: "unixgram"}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		os.Exit(2)
+	}
+	for _, arg := range args {
+		if wait, ok := strings.CutPrefix(arg, "sleep="); ok {
+			d, _ := time.ParseDuration(wait)
+			time.Sleep(d)
+		} else if name, ok := strings.CutPrefix(arg, "status-env="); ok {
+			conn.Write([]byte("STATUS=" + os.Getenv(name)))
+		} else if _, err := conn.Write([]byte(strings.ReplaceAll(arg, ";", "\n"))); err != nil {
+			os.Exit(2)
+		}
+	}
+	time.Sleep(30 * time.Second)
+	os.Exit(0)
+}
+
+func createNotifyTree(t *testing.T, extra string, messages ...string) *tree.TreeImpl {
+	tree.RuntimeDir = t.TempDir()
+	envFile := filepath.Join(t.TempDir(), "helper.env")
+	noErr(t, os.WriteFile(envFile, []byte("GO_WANT_HELPER_PROCESS=1\n"), 0644))
+
+	command := os.Args[0] + " -test.run=^TestNotifyHelper$ --"
+	for _, msg := range messages {
+		command += " '" + msg + "'"
+	}
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name notifier\nType notify\nCommand "+command+"\nEnvironmentFile "+envFile+"\n"+extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return treeImpl
+}
+
+func treeStatus(t *testing.T, treeImpl *tree.TreeImpl) *tree.Status {
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	return status
+}
+
+func TestNotifyReady(t *testing.T) {
+	treeImpl := createNotifyTree(t, "", "STATUS=warming up", "sleep=500ms", "READY=1;STATUS=serving")
+	startTree(t, treeImpl)
+
+	time.Sleep(250 * time.Millisecond)
+	if status := treeStatus(t, treeImpl); status.State != tree.StartingState || status.StatusText != "warming up" {
+		t.Errorf("unexpected status before ready: %s %q", status.State, status.StatusText)
+	}
+
+	time.Sleep(time.Second)
+	if status := treeStatus(t, treeImpl); status.State != tree.RunningState || status.StatusText != "serving" {
+		t.Errorf("unexpected status after ready: %s %q", status.State, status.StatusText)
+	}
+}
+
+func TestNotifyStopping(t *testing.T) {
+	treeImpl := createNotifyTree(t, "", "READY=1", "sleep=300ms", "STOPPING=1")
+	startTree(t, treeImpl)
+
+	time.Sleep(800 * time.Millisecond)
+	if status := treeStatus(t, treeImpl); status.State != tree.StoppingState {
+		t.Errorf("unexpected state: %s", status.State)
+	}
+}
+
+func TestNotifyStartTimeout(t *testing.T) {
+	treeImpl := createNotifyTree(t, "StartTimeout 300ms\n", "STATUS=never ready")
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+	select {
+	case <-errChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tree did not time out")
+	}
+
+	status := treeStatus(t, treeImpl)
+	if status.State != tree.StoppedState || status.ExitReason != tree.TimeoutReason {
+		t.Errorf("unexpected status: %s %s", status.State, status.ExitReason)
+	}
+	if len(status.LastError) == 0 {
+		t.Error("expected start timeout error")
+	}
+}
+
+func TestForkingType(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "daemon.pid")
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name forking\nType forking\nPIDFile "+pidFile+"\nCommand sh -c 'sleep 30 & echo $! > "+pidFile+"'\n"))
+	noErr(t, err)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+	time.Sleep(500 * time.Millisecond)
+
+	status := treeStatus(t, treeImpl)
+	pid := childPid(t, pidFile)
+	if status.State != tree.RunningState || status.Pid != pid {
+		t.Errorf("unexpected status: %s pid %d, expected pid %d", status.State, status.Pid, pid)
+	}
+
+	noErr(t, treeImpl.Stop(context.Background()))
+	select {
+	case <-errChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tree did not stop")
+	}
+	if processAlive(pid) {
+		t.Errorf("daemon process %d is still running", pid)
+	}
+}
+
+func TestWatchdog(t *testing.T) {
+	treeImpl := createNotifyTree(t, "WatchdogSec 300ms\nRestartDelay 1h\n", "READY=1", "status-env=WATCHDOG_PID", "WATCHDOG=1", "sleep=200ms", "WATCHDOG=1", "sleep=200ms", "WATCHDOG=1")
+	startTree(t, treeImpl)
+
+	time.Sleep(300 * time.Millisecond)
+	status := treeStatus(t, treeImpl)
+	if status.State != tree.RunningState || status.StatusText != strconv.Itoa(status.Pid) {
+		t.Errorf("unexpected status: %s, WATCHDOG_PID %q for pid %d", status.State, status.StatusText, status.Pid)
+	}
+
+	time.Sleep(time.Second)
+	status = treeStatus(t, treeImpl)
+	if status.State != tree.RestartingState || status.ExitReason != tree.WatchdogReason {
+		t.Errorf("unexpected status after missed watchdog: %s %s", status.State, status.ExitReason)
+	}
+}
@@ -0,0 +1,304 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	stdoutStream = "stdout"
+	stderrStream = "stderr"
+)
+
+// runOutput is where the standard streams of one run of a tree go.
+type runOutput struct {
+	streams []*streamOutput // stdout, then stderr
+	sinks   []logSink
+	files   []*RotatingFileWriter // the sinks that are log files
+}
+
+// openOutput opens the destinations of the standard streams of cfg. A stream
+// whose destination cannot be opened is only kept in memory.
+func (t *TreeImpl) openOutput(cfg Config) *runOutput {
+	out := &runOutput{}
+	sinks := map[Output]logSink{}
+	for _, stream := range []string{stdoutStream, stderrStream} {
+		dest := cfg.StandardOutput
+		if stream == stderrStream {
+			dest = cfg.StandardError
+		}
+		if dest == LogOutput {
+			dest = Output(cfg.LogFile)
+		}
+		so := &streamOutput{
+			t:          t,
+			name:       cfg.Name,
+			stream:     stream,
+			timestamps: cfg.LogTimestamps,
+			logFormat:  cfg.LogFormat,
+		}
+		sink, opened := sinks[dest]
+		if !opened {
+			sink = out.openSink(cfg, dest)
+			sinks[dest] = sink
+		}
+		so.sink = sink
+		_, so.file = sink.(*RotatingFileWriter)
+		so.follow = string(dest) == cfg.LogFile
+		out.streams = append(out.streams, so)
+	}
+	return out
+}
+
+// openSink opens the sink of dest, or returns nil if output to dest is
+// discarded or dest cannot be opened.
+func (o *runOutput) openSink(cfg Config, dest Output) logSink {
+	switch dest {
+	case NullOutput:
+		return nil
+	case InheritOutput:
+		sink := inheritSink{name: cfg.Name}
+		o.sinks = append(o.sinks, sink)
+		return sink
+	case SyslogOutput, JournalOutput:
+		var sink *socketSink
+		var err error
+		if dest == SyslogOutput {
+			sink, err = dialSyslog(cfg.Name, cfg.SyslogAddress)
+		} else {
+			sink, err = dialJournal(cfg.Name)
+		}
+		if err != nil {
+			slog.Warn("cannot connect to "+string(dest)+", keeping output in memory only", "name", cfg.Name, "err", err)
+			return nil
+		}
+		o.sinks = append(o.sinks, sink)
+		return sink
+	}
+	file := openLog(cfg.Name, string(dest), cfg.LogRotation())
+	if file == nil {
+		return nil
+	}
+	o.sinks = append(o.sinks, file)
+	o.files = append(o.files, file)
+	return file
+}
+
+// openLog opens a log file of a tree. A tree whose log file cannot be opened
+// still runs, its output is only kept in memory.
+func openLog(name string, path string, rotation LogRotation) *RotatingFileWriter {
+	logger, err := NewRotatingFileWriter(path, rotation)
+	if err != nil {
+		slog.Warn("cannot open log file, keeping output in memory only", "name", name, "log", path, "err", err)
+		return nil
+	}
+	return logger
+}
+
+// file returns the writer of the log file at path, or nil if the run does not
+// write to it.
+func (o *runOutput) file(path string) *RotatingFileWriter {
+	for _, file := range o.files {
+		if file.path == path {
+			return file
+		}
+	}
+	return nil
+}
+
+// setProcess records the process the output comes from and its run, before
+// it is copied.
+func (o *runOutput) setProcess(pid int, run int) {
+	for _, so := range o.streams {
+		so.pid = pid
+		so.run = run
+	}
+}
+
+func (o *runOutput) rotate() error {
+	var err error
+	for _, file := range o.files {
+		err = errors.Join(err, file.Rotate())
+	}
+	return err
+}
+
+func (o *runOutput) close() {
+	for _, sink := range o.sinks {
+		sink.Close()
+	}
+}
+
+// copyOutput copies the output of each stream from its pipe, stdout first,
+// until every process holding the pipes has exited, then closes done.
+func (t *TreeImpl) copyOutput(pipes []*os.File, out *runOutput, done chan struct{}) {
+	var wg sync.WaitGroup
+	for i, pipe := range pipes {
+		wg.Go(func() {
+			lines := &lineWriter{write: out.streams[i].writeLine}
+			if _, err := io.Copy(lines, pipe); err != nil {
+				slog.Warn("failed to copy tree output", "stream", out.streams[i].stream, "err", err)
+			}
+			lines.flush()
+			pipe.Close()
+		})
+	}
+	wg.Wait()
+	close(done)
+
+	t.stateMu.Lock()
+	if t.runOutput == out {
+		t.runOutput = nil
+	}
+	t.stateMu.Unlock()
+	out.close()
+}
+
+// streamOutput writes the lines of one stream of a tree to where the stream
+// goes, and into the tree's output buffer.
+type streamOutput struct {
+	t          *TreeImpl
+	name       string
+	stream     string
+	timestamps bool
+	logFormat  LogFormat
+	pid        int
+	run        int
+
+	sink    logSink
+	sinkErr error
+	file    bool // the sink is a log file, written along with the output buffer
+	follow  bool // the stream goes to the log file followers read
+}
+
+func (o *streamOutput) writeLine(line []byte) {
+	entry := logEntry{stream: o.stream, pid: o.pid, line: line}
+	o.t.outputMu.Lock()
+	o.t.output.Write(line)
+	o.t.output.Write([]byte{'\n'})
+	if o.file || o.follow {
+		entry.formatted = o.format(line)
+	}
+	if o.file {
+		o.write(entry)
+	}
+	if o.follow {
+		o.t.publish(entry.formatted)
+	}
+	o.t.outputMu.Unlock()
+
+	if o.sink != nil && !o.file {
+		o.write(entry)
+	}
+}
+
+// write passes entry on to the sink, warning when it starts failing.
+func (o *streamOutput) write(entry logEntry) {
+	err := o.sink.writeEntry(entry)
+	if err != nil && o.sinkErr == nil {
+		slog.Warn("failed to write tree output", "name", o.name, "stream", o.stream, "err", err)
+	}
+	o.sinkErr = err
+}
+
+// format returns line as it is written to a file, prefixed with the time and
+// the stream if the tree logs timestamps, or in a logRecord for JSON.
+func (o *streamOutput) format(line []byte) []byte {
+	if o.logFormat == JSONLogFormat {
+		return o.formatJSON(line)
+	}
+	formatted := make([]byte, 0, len(line)+len(time.RFC3339)+len(o.stream)+4)
+	if o.timestamps {
+		formatted = time.Now().AppendFormat(formatted, time.RFC3339)
+		formatted = append(formatted, ' ')
+		formatted = append(formatted, o.stream...)
+		formatted = append(formatted, ": "...)
+	}
+	formatted = append(formatted, line...)
+	return append(formatted, '\n')
+}
+
+// logRecord is a line of output in the JSON log format. A line that is a JSON
+// object is kept as is, any other line is a string.
+type logRecord struct {
+	Timestamp time.Time `json:"timestamp"`
+	Tree      string    `json:"tree"`
+	Stream    string    `json:"stream"`
+	Pid       int       `json:"pid"`
+	Run       int       `json:"run"`
+	Message   any       `json:"message"`
+}
+
+func (o *streamOutput) formatJSON(line []byte) []byte {
+	record := logRecord{
+		Timestamp: time.Now(),
+		Tree:      o.name,
+		Stream:    o.stream,
+		Pid:       o.pid,
+		Run:       o.run,
+		Message:   string(line),
+	}
+	if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed) {
+		record.Message = json.RawMessage(trimmed)
+	}
+	// cannot fail, the message is valid JSON or a string
+	formatted, _ := json.Marshal(record)
+	return append(formatted, '\n')
+}
+
+// lineWriter passes each line written to it on to write, without the newline.
+// A partial line is held back until it is completed, grows too long, or is
+// flushed. The line passed to write is only valid during the call.
+type lineWriter struct {
+	write   func(line []byte)
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		line, rest, complete := bytes.Cut(p, []byte{'\n'})
+		if !complete {
+			w.partial = append(w.partial, line...)
+			for len(w.partial) >= maxOutputLineLength {
+				w.write(w.partial[:maxOutputLineLength])
+				w.partial = append(w.partial[:0], w.partial[maxOutputLineLength:]...)
+			}
+			break
+		}
+		if len(w.partial) > 0 {
+			line = append(w.partial, line...)
+			w.partial = w.partial[:0]
+		}
+		w.write(line)
+		p = rest
+	}
+	return n, nil
+}
+
+// flush passes on the partial line, if any, once the stream ended.
+func (w *lineWriter) flush() {
+	if len(w.partial) > 0 {
+		w.write(w.partial)
+		w.partial = w.partial[:0]
+	}
+}
+
+// publish passes output written to the log file on to the clients following
+// the tree, which share data. The caller must hold outputMu.
+func (t *TreeImpl) publish(data []byte) {
+	for follower := range t.followers {
+		select {
+		case follower <- data:
+		default:
+			close(follower)
+			delete(t.followers, follower)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	groupPollInterval   = 100 * time.Millisecond
+	processPollInterval = 100 * time.Millisecond
+	pidFileAttempts     = 10
+)
+
+// process is a single run of a tree.
+type process struct {
+	cmd       *exec.Cmd // nil for adopted processes
+	pid       int
+	pgid      int
+	cgroup    string // empty without cgroups
+	env       []string
+	notify    *notifySocket
+	ready     chan struct{}
+	readyOnce sync.Once
+	watchdog  chan struct{}
+	// outputDone is closed once every process holding the output pipe exited
+	outputDone chan struct{}
+	outputMark int // lines in the output buffer when the process started
+}
+
+// markReady records that the tree finished starting up.
+func (p *process) markReady() {
+	p.readyOnce.Do(func() {
+		close(p.ready)
+	})
+}
+
+// exitResult is how the main process of a run ended. The process state is
+// nil when pine could not wait for the main process itself.
+type exitResult struct {
+	state *os.ProcessState
+	err   error
+}
+
+// signalTree delivers sig to the tree whose main process is pid in the
+// process group pgid. Depending on the kill mode the signal goes to the main
+// process or to every process in the group, or in the cgroup if the tree has
+// one.
+func signalTree(pid int, pgid int, cgroup string, mode KillMode, sig syscall.Signal) error {
+	target := pid
+	if mode == GroupKillMode || (mode == MixedKillMode && sig == syscall.SIGKILL) {
+		if len(cgroup) > 0 {
+			return signalCgroup(cgroup, sig)
+		}
+		target = -pgid
+	}
+	if err := syscall.Kill(target, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	return nil
+}
+
+// processGroup returns the process group of pid, or 0 if it does not exist.
+func processGroup(pid int) int {
+	pgid, err := syscall.Getpgid(pid)
+	if err != nil {
+		return 0
+	}
+	return pgid
+}
+
+// processExists reports whether pid is a live process. Unlike waiting on a
+// child, this works for processes pine did not start itself.
+func processExists(pid int) bool {
+	if err := syscall.Kill(pid, 0); err != nil && !errors.Is(err, syscall.EPERM) {
+		return false
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return true
+	}
+	idx := strings.LastIndexByte(string(stat), ')')
+	return idx < 0 || !strings.HasPrefix(string(stat[idx+1:]), " Z")
+}
+
+// waitForExit polls until pid no longer exists. The exit status of a process
+// that is not a child of pine cannot be known.
+func waitForExit(pid int) {
+	ticker := time.NewTicker(processPollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !processExists(pid) {
+			return
+		}
+	}
+}
+
+// readPIDFile reads the main pid of a forking tree, giving the tree a moment
+// to write the file after its parent process exits.
+func readPIDFile(filename string) (int, error) {
+	var err error
+	for range pidFileAttempts {
+		var data []byte
+		if data, err = os.ReadFile(filename); err == nil {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+			if err != nil || pid <= 0 {
+				return 0, fmt.Errorf("invalid pid file %s", filename)
+			}
+			if !processExists(pid) {
+				return 0, fmt.Errorf("process %d from pid file %s does not exist", pid, filename)
+			}
+			return pid, nil
+		}
+		time.Sleep(processPollInterval)
+	}
+	return 0, err
+}
+
+// ProcessStartTime returns when pid started, in clock ticks since boot. Along
+// with the pid it identifies a process even if the pid is reused later.
+func ProcessStartTime(pid int) (uint64, error) {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	idx := strings.LastIndexByte(string(stat), ')')
+	if idx < 0 {
+		return 0, fmt.Errorf("invalid stat for process %d", pid)
+	}
+	// the fields after the command name start at the third field of stat
+	fields := strings.Fields(string(stat[idx+1:]))
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid stat for process %d", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// treeAlive reports whether any live process remains in the tree's cgroup, or
+// in its process group without one.
+func treeAlive(pgid int, cgroup string) bool {
+	if len(cgroup) > 0 {
+		return cgroupPopulated(cgroup)
+	}
+	return groupAlive(pgid)
+}
+
+// groupAlive reports whether any live process remains in the process group
+// pgid. Zombies are ignored since they cannot be signalled anyway.
+func groupAlive(pgid int) bool {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return syscall.Kill(-pgid, 0) == nil
+	}
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// the command name may contain spaces, so parse after its closing paren
+		idx := strings.LastIndexByte(string(stat), ')')
+		if idx < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[idx+1:]))
+		if len(fields) < 3 || fields[0] == "Z" {
+			continue
+		}
+		if pgrp, err := strconv.Atoi(fields[2]); err == nil && pgrp == pgid {
+			return true
+		}
+	}
+	return false
+}
@@ -1,8 +1,10 @@
 package tree_test
 
 import (
+	"bytes"
 	"context"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -77,3 +79,50 @@ func TestRestartDuringReload(t *testing.T) {
 	cancel()
 	<-errChan
 }
+
+func TestReloadResizesOutputOfFailingRun(t *testing.T) {
+	for _, size := range []string{"2", "0"} {
+		filename := createTreeFile(t, "Name Resize\nShell yes\nOutputBufferLines 10\nRestartDelay 10ms\n"+
+			"Command echo one; echo two; echo three; trap 'exit 3' TERM; while :; do sleep 0.1; done\n")
+		treeImpl, err := tree.NewTree(filename)
+		noErr(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- treeImpl.Start(ctx)
+		}()
+
+		waitFor := func(what string, done func(*tree.Status) bool) {
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				status, err := treeImpl.Status(context.Background())
+				noErr(t, err)
+				if done(status) {
+					return
+				} else if time.Now().After(deadline) {
+					t.Fatalf("size %s: %s: %+v", size, what, status)
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}
+		waitFor("no output from first run", func(s *tree.Status) bool { return len(treeImpl.RecentOutput()) == 3 })
+		noErr(t, treeImpl.Restart(context.Background()))
+		waitFor("no output from second run", func(s *tree.Status) bool {
+			output := treeImpl.RecentOutput()
+			return s.RunCount == 2 && len(output) > 6 && output[len(output)-1] == "three"
+		})
+
+		// the second run fails on the stop signal after its output shrank
+		contents, err := os.ReadFile(filename)
+		noErr(t, err)
+		contents = bytes.Replace(contents, []byte("OutputBufferLines 10"), []byte("OutputBufferLines "+size), 1)
+		noErr(t, os.WriteFile(filename, contents, 0644))
+		noErr(t, treeImpl.Reload(context.Background()))
+		waitFor("tree did not restart", func(s *tree.Status) bool {
+			return s.RunCount == 3 && s.State == tree.RunningState && strings.Contains(s.LastError, "exit status 3")
+		})
+
+		cancel()
+		<-errChan
+	}
+}
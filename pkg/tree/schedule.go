@@ -0,0 +1,292 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron or systemd OnCalendar expression. Each field is a
+// bit set of the values it matches.
+type Schedule struct {
+	Expr string
+
+	seconds  uint64
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64 // Sunday is 0
+	years    []int  // any year if empty
+
+	// dayOr matches a day if either the day of month or the weekday matches,
+	// as cron does when both are restricted.
+	dayOr bool
+}
+
+// maxScheduleYears bounds how far ahead Next looks for a matching time.
+const maxScheduleYears = 5
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var calendarShorthands = map[string]string{
+	"minutely":     "*-*-* *:*:00",
+	"hourly":       "*-*-* *:00:00",
+	"daily":        "*-*-* 00:00:00",
+	"weekly":       "Mon *-*-* 00:00:00",
+	"monthly":      "*-*-01 00:00:00",
+	"quarterly":    "*-01,04,07,10-01 00:00:00",
+	"semiannually": "*-01,07-01 00:00:00",
+	"yearly":       "*-01-01 00:00:00",
+	"annually":     "*-01-01 00:00:00",
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var weekdayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	"sunday": 0, "monday": 1, "tuesday": 2, "wednesday": 3, "thursday": 4, "friday": 5, "saturday": 6,
+}
+
+// ParseSchedule parses a five field cron expression such as "30 2 * * 1-5",
+// a cron macro such as "@daily", or a systemd OnCalendar expression such as
+// "Mon..Fri *-*-* 02:30:00" or "weekly".
+func ParseSchedule(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if macro, ok := cronMacros[strings.ToLower(expr)]; ok {
+		sched, err := parseCron(macro)
+		sched.Expr = expr
+		return sched, err
+	} else if strings.HasPrefix(expr, "@") {
+		return Schedule{}, fmt.Errorf("unknown macro '%s'", expr)
+	}
+	if len(strings.Fields(expr)) == 5 {
+		sched, err := parseCron(expr)
+		sched.Expr = expr
+		return sched, err
+	}
+	sched, err := parseCalendar(expr)
+	sched.Expr = expr
+	return sched, err
+}
+
+func parseCron(expr string) (Schedule, error) {
+	fields := strings.Fields(expr)
+	sched := Schedule{seconds: 1}
+	var err error
+	if sched.minutes, err = parseScheduleField(fields[0], 0, 59, nil, "-"); err != nil {
+		return sched, fmt.Errorf("invalid minute: %w", err)
+	}
+	if sched.hours, err = parseScheduleField(fields[1], 0, 23, nil, "-"); err != nil {
+		return sched, fmt.Errorf("invalid hour: %w", err)
+	}
+	if sched.days, err = parseScheduleField(fields[2], 1, 31, nil, "-"); err != nil {
+		return sched, fmt.Errorf("invalid day of month: %w", err)
+	}
+	if sched.months, err = parseScheduleField(fields[3], 1, 12, monthNames, "-"); err != nil {
+		return sched, fmt.Errorf("invalid month: %w", err)
+	}
+	if sched.weekdays, err = parseScheduleField(fields[4], 0, 7, weekdayNames, "-"); err != nil {
+		return sched, fmt.Errorf("invalid day of week: %w", err)
+	}
+	// 7 is another name for Sunday
+	if sched.weekdays&(1<<7) != 0 {
+		sched.weekdays = sched.weekdays&^(1<<7) | 1
+	}
+	sched.dayOr = fields[2][0] != '*' && fields[4][0] != '*'
+	return sched, nil
+}
+
+// parseCalendar parses an OnCalendar expression of the form
+// "[weekdays] [[year-]month-day] [hour:minute[:second]]".
+func parseCalendar(expr string) (Schedule, error) {
+	if shorthand, ok := calendarShorthands[strings.ToLower(expr)]; ok {
+		expr = shorthand
+	}
+	fields := strings.Fields(expr)
+	if len(fields) == 0 || len(fields) > 3 {
+		return Schedule{}, errors.New("invalid calendar expression")
+	}
+
+	weekdays, date, clock := "*", "*-*-*", "00:00:00"
+	if first := fields[0]; !strings.ContainsAny(first, "-:") {
+		weekdays = first
+		fields = fields[1:]
+	}
+	if len(fields) > 0 && !strings.Contains(fields[0], ":") {
+		date = fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) > 0 {
+		clock = fields[0]
+		fields = fields[1:]
+	}
+	if len(fields) > 0 {
+		return Schedule{}, errors.New("invalid calendar expression")
+	}
+
+	sched := Schedule{}
+	var err error
+	if sched.weekdays, err = parseScheduleField(weekdays, 0, 6, weekdayNames, ".."); err != nil {
+		return sched, fmt.Errorf("invalid weekday: %w", err)
+	}
+
+	dateParts := strings.Split(date, "-")
+	switch len(dateParts) {
+	case 2:
+		dateParts = append([]string{"*"}, dateParts...)
+	case 3:
+	default:
+		return sched, fmt.Errorf("invalid date '%s'", date)
+	}
+	if dateParts[0] != "*" {
+		years, err := parseScheduleList(dateParts[0], 1970, 2199, nil, "..")
+		if err != nil {
+			return sched, fmt.Errorf("invalid year: %w", err)
+		}
+		sched.years = years
+	}
+	if sched.months, err = parseScheduleField(dateParts[1], 1, 12, nil, ".."); err != nil {
+		return sched, fmt.Errorf("invalid month: %w", err)
+	}
+	if sched.days, err = parseScheduleField(dateParts[2], 1, 31, nil, ".."); err != nil {
+		return sched, fmt.Errorf("invalid day: %w", err)
+	}
+
+	clockParts := strings.Split(clock, ":")
+	switch len(clockParts) {
+	case 2:
+		clockParts = append(clockParts, "00")
+	case 3:
+	default:
+		return sched, fmt.Errorf("invalid time '%s'", clock)
+	}
+	if sched.hours, err = parseScheduleField(clockParts[0], 0, 23, nil, ".."); err != nil {
+		return sched, fmt.Errorf("invalid hour: %w", err)
+	}
+	if sched.minutes, err = parseScheduleField(clockParts[1], 0, 59, nil, ".."); err != nil {
+		return sched, fmt.Errorf("invalid minute: %w", err)
+	}
+	if sched.seconds, err = parseScheduleField(clockParts[2], 0, 59, nil, ".."); err != nil {
+		return sched, fmt.Errorf("invalid second: %w", err)
+	}
+	return sched, nil
+}
+
+// parseScheduleField parses a comma separated list of values, ranges joined
+// by rangeSep, and repetitions such as "*/15" or "5/10" into a bit set.
+func parseScheduleField(field string, min, max int, names map[string]int, rangeSep string) (uint64, error) {
+	values, err := parseScheduleList(field, min, max, names, rangeSep)
+	if err != nil {
+		return 0, err
+	}
+	var bits uint64
+	for _, value := range values {
+		bits |= 1 << uint(value)
+	}
+	return bits, nil
+}
+
+func parseScheduleList(field string, min, max int, names map[string]int, rangeSep string) ([]int, error) {
+	values := []int{}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepPart); err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step '%s'", stepPart)
+			}
+		}
+
+		start, end := min, max
+		if rangePart != "*" {
+			lowPart, highPart, isRange := strings.Cut(rangePart, rangeSep)
+			var err error
+			if start, err = parseScheduleValue(lowPart, min, max, names); err != nil {
+				return nil, err
+			}
+			end = start
+			if isRange {
+				if end, err = parseScheduleValue(highPart, min, max, names); err != nil {
+					return nil, err
+				}
+			} else if hasStep {
+				end = max
+			}
+			if end < start {
+				return nil, fmt.Errorf("invalid range '%s'", rangePart)
+			}
+		}
+		for value := start; value <= end; value += step {
+			if !slices.Contains(values, value) {
+				values = append(values, value)
+			}
+		}
+	}
+	slices.Sort(values)
+	return values, nil
+}
+
+func parseScheduleValue(value string, min, max int, names map[string]int) (int, error) {
+	if num, ok := names[strings.ToLower(value)]; ok {
+		return num, nil
+	}
+	num, err := strconv.Atoi(value)
+	if err != nil || num < min || num > max {
+		return 0, fmt.Errorf("invalid value '%s'", value)
+	}
+	return num, nil
+}
+
+// Next returns the first time after after that matches the schedule, or the
+// zero time if there is none within the next few years.
+func (s Schedule) Next(after time.Time) time.Time {
+	loc := after.Location()
+	t := after.Truncate(time.Second).Add(time.Second)
+	limit := t.AddDate(maxScheduleYears, 0, 0)
+	for t.Before(limit) {
+		if len(s.years) > 0 && !slices.Contains(s.years, t.Year()) {
+			if t.Year() > s.years[len(s.years)-1] {
+				break
+			}
+			t = time.Date(t.Year()+1, 1, 1, 0, 0, 0, 0, loc)
+		} else if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		} else if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		} else if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		} else if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, loc)
+		} else if s.seconds&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+		} else {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (s Schedule) matchDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	if s.dayOr {
+		return day || weekday
+	}
+	return day && weekday
+}
@@ -0,0 +1,70 @@
+package tree_test
+
+import (
+	"testing"
+	"time"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+func TestScheduleNext(t *testing.T) {
+	// a Wednesday
+	now := time.Date(2026, 3, 4, 10, 15, 30, 0, time.UTC)
+	for _, tc := range []struct {
+		expr string
+		next time.Time
+	}{
+		{"*/15 * * * *", time.Date(2026, 3, 4, 10, 30, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2026, 3, 5, 2, 0, 0, 0, time.UTC)},
+		{"30 9 * * mon-fri", time.Date(2026, 3, 5, 9, 30, 0, 0, time.UTC)},
+		{"0 0 1 * 0", time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2026, 3, 4, 11, 0, 0, 0, time.UTC)},
+		{"@weekly", time.Date(2026, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{"daily", time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC)},
+		{"weekly", time.Date(2026, 3, 9, 0, 0, 0, 0, time.UTC)},
+		{"monthly", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"*-*-* 04:00", time.Date(2026, 3, 5, 4, 0, 0, 0, time.UTC)},
+		{"Sat,Sun *-*-* 12:00:00", time.Date(2026, 3, 7, 12, 0, 0, 0, time.UTC)},
+		{"Mon..Fri 18:30", time.Date(2026, 3, 4, 18, 30, 0, 0, time.UTC)},
+		{"*-*-01 *:0/20:00", time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"*:*:45", time.Date(2026, 3, 4, 10, 15, 45, 0, time.UTC)},
+		{"2027-01-01", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		sched, err := tree.ParseSchedule(tc.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tc.expr, err)
+			continue
+		}
+		if next := sched.Next(now); !next.Equal(tc.next) {
+			t.Errorf("%s: expected next run %s, got %s", tc.expr, tc.next, next)
+		}
+	}
+}
+
+func TestScheduleNoNextRun(t *testing.T) {
+	sched, err := tree.ParseSchedule("2020-01-01 00:00:00")
+	noErr(t, err)
+	if next := sched.Next(time.Now()); !next.IsZero() {
+		t.Errorf("unexpected next run: %s", next)
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"@sometimes",
+		"60 * * * *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"Funday 10:00",
+		"*-13-01",
+		"25:00",
+		"* * *",
+	} {
+		if _, err := tree.ParseSchedule(expr); err == nil {
+			t.Errorf("expected error for '%s'", expr)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package tree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// LookupFunc resolves a variable name for expansion in SplitCommand.
+type LookupFunc func(name string) (string, bool)
+
+// SplitCommand splits cmd into words following POSIX shell quoting rules.
+// Words are separated by unquoted blanks, single quotes preserve their
+// contents literally, double quotes allow $VAR and ${VAR} expansion, and a
+// backslash escapes the following character. Expanded values are never split
+// into multiple words, and a word that is only empty unquoted expansions is
+// dropped as in a shell. A nil lookup expands every variable to the empty
+// string.
+func SplitCommand(cmd string, lookup LookupFunc) ([]string, error) {
+	if lookup == nil {
+		lookup = func(string) (string, bool) { return "", false }
+	}
+
+	words := []string{}
+	var word strings.Builder
+	inWord := false
+	for i := 0; i < len(cmd); i++ {
+		c := cmd[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case c == '\\':
+			if i+1 >= len(cmd) {
+				return nil, errors.New("trailing backslash")
+			}
+			i++
+			if cmd[i] != '\n' {
+				word.WriteByte(cmd[i])
+				inWord = true
+			}
+		case c == '\'':
+			end := strings.IndexByte(cmd[i+1:], '\'')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated single quote at column %d", i+1)
+			}
+			word.WriteString(cmd[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == '"':
+			next, err := splitDoubleQuoted(cmd, i, &word, lookup)
+			if err != nil {
+				return nil, err
+			}
+			i = next
+			inWord = true
+		case c == '$':
+			next, err := expandVariable(cmd, i, &word, lookup)
+			if err != nil {
+				return nil, err
+			}
+			i = next
+			// an empty expansion only makes a word if part of it is quoted
+			inWord = inWord || word.Len() > 0
+		case c == '`':
+			return nil, fmt.Errorf("command substitution is not supported at column %d, use Shell", i+1)
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// splitDoubleQuoted consumes the double quoted string starting at cmd[start]
+// and returns the index of the closing quote.
+func splitDoubleQuoted(cmd string, start int, word *strings.Builder, lookup LookupFunc) (int, error) {
+	for i := start + 1; i < len(cmd); i++ {
+		switch c := cmd[i]; c {
+		case '"':
+			return i, nil
+		case '\\':
+			if i+1 < len(cmd) && strings.IndexByte("$`\"\\\n", cmd[i+1]) >= 0 {
+				i++
+				if cmd[i] != '\n' {
+					word.WriteByte(cmd[i])
+				}
+			} else {
+				word.WriteByte(c)
+			}
+		case '$':
+			next, err := expandVariable(cmd, i, word, lookup)
+			if err != nil {
+				return 0, err
+			}
+			i = next
+		case '`':
+			return 0, fmt.Errorf("command substitution is not supported at column %d, use Shell", i+1)
+		default:
+			word.WriteByte(c)
+		}
+	}
+	return 0, fmt.Errorf("unterminated double quote at column %d", start+1)
+}
+
+// expandVariable expands the $VAR or ${VAR} reference starting at cmd[start]
+// and returns the index of its last character. A '$' that does not start a
+// variable name is kept as is.
+func expandVariable(cmd string, start int, word *strings.Builder, lookup LookupFunc) (int, error) {
+	i := start + 1
+	if i < len(cmd) && cmd[i] == '(' {
+		return 0, fmt.Errorf("command substitution is not supported at column %d, use Shell", start+1)
+	}
+	if i < len(cmd) && cmd[i] == '{' {
+		end := strings.IndexByte(cmd[i+1:], '}')
+		if end < 0 {
+			return 0, fmt.Errorf("unterminated variable reference at column %d", start+1)
+		}
+		name := cmd[i+1 : i+1+end]
+		if !isVariableName(name) {
+			return 0, fmt.Errorf("invalid variable name '%s' at column %d", name, start+1)
+		}
+		value, _ := lookup(name)
+		word.WriteString(value)
+		return i + 1 + end, nil
+	}
+
+	end := i
+	for end < len(cmd) && isVariableChar(cmd[end], end == i) {
+		end++
+	}
+	if end == i {
+		word.WriteByte('$')
+		return start, nil
+	}
+	value, _ := lookup(cmd[i:end])
+	word.WriteString(value)
+	return end - 1, nil
+}
+
+func isVariableName(name string) bool {
+	if len(name) == 0 {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isVariableChar(name[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isVariableChar(c byte, first bool) bool {
+	if c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+		return true
+	}
+	return !first && c >= '0' && c <= '9'
+}
+
+// lookupEnv returns a LookupFunc over env, a list of KEY=value pairs. A nil
+// env resolves variables from pine's own environment.
+func lookupEnv(env []string) LookupFunc {
+	if env == nil {
+		return os.LookupEnv
+	}
+	return func(name string) (string, bool) {
+		for i := len(env) - 1; i >= 0; i-- {
+			if key, value, ok := strings.Cut(env[i], "="); ok && key == name {
+				return value, true
+			}
+		}
+		return "", false
+	}
+}
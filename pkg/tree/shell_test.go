@@ -0,0 +1,61 @@
+package tree_test
+
+import (
+	"slices"
+	"testing"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+func TestSplitCommand(t *testing.T) {
+	env := map[string]string{
+		"HOME": "/home/op",
+		"ARGS": "a b",
+	}
+	lookup := func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+
+	tests := []struct {
+		cmd  string
+		want []string
+	}{
+		{"sleep infinity", []string{"sleep", "infinity"}},
+		{"  sleep \t  10  ", []string{"sleep", "10"}},
+		{`echo 'hello world'`, []string{"echo", "hello world"}},
+		{`echo "hello  world"`, []string{"echo", "hello  world"}},
+		{`echo hello\ world`, []string{"echo", "hello world"}},
+		{`echo "" ''`, []string{"echo", "", ""}},
+		{`echo '$HOME' "$HOME" $HOME`, []string{"echo", "$HOME", "/home/op", "/home/op"}},
+		{`ls ${HOME}/bin $ARGS`, []string{"ls", "/home/op/bin", "a b"}},
+		{`echo $MISSING x`, []string{"echo", "x"}},
+		{`echo $MISSING${MISSING} x$MISSING "$MISSING" $MISSING''`, []string{"echo", "x", "", ""}},
+		{`echo "a \"b\" \$c \d"`, []string{"echo", `a "b" $c \d`}},
+		{`echo cost$ 5$`, []string{"echo", "cost$", "5$"}},
+		{`--flag="$HOME/x y"`, []string{"--flag=/home/op/x y"}},
+	}
+	for _, tc := range tests {
+		got, err := tree.SplitCommand(tc.cmd, lookup)
+		noErr(t, err)
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("SplitCommand(%q) = %q, want %q", tc.cmd, got, tc.want)
+		}
+	}
+}
+
+func TestSplitCommandErrors(t *testing.T) {
+	for _, cmd := range []string{
+		`echo 'unterminated`,
+		`echo "unterminated`,
+		`echo trailing\`,
+		`echo ${HOME`,
+		`echo ${1bad}`,
+		"echo `date`",
+		`echo $(date)`,
+	} {
+		if _, err := tree.SplitCommand(cmd, nil); err == nil {
+			t.Errorf("expected error for %q", cmd)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+package tree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	JournalSocket = "/run/systemd/journal/socket"
+)
+
+const (
+	syslogFacility  = 3 // daemon
+	stdoutPriority  = 6 // info
+	stderrPriority  = 3 // err
+	maxSyslogAppLen = 48
+)
+
+// logEntry is a line of output of a tree passed to a logSink.
+type logEntry struct {
+	stream    string
+	pid       int
+	line      []byte // without the newline
+	formatted []byte // as written to a file, with the newline
+}
+
+// priority returns the syslog severity of the entry's stream.
+func (e logEntry) priority() int {
+	if e.stream == stderrStream {
+		return stderrPriority
+	}
+	return stdoutPriority
+}
+
+// logSink is where a stream of a tree sends its output, one line at a time.
+// A sink may be shared by both streams of a tree.
+type logSink interface {
+	writeEntry(entry logEntry) error
+	io.Closer
+}
+
+var (
+	_ logSink = (*RotatingFileWriter)(nil)
+	_ logSink = (*socketSink)(nil)
+	_ logSink = inheritSink{}
+)
+
+func (w *RotatingFileWriter) writeEntry(entry logEntry) error {
+	_, err := w.Write(entry.formatted)
+	return err
+}
+
+// inheritSink writes output to pine's own log.
+type inheritSink struct {
+	name string
+}
+
+func (s inheritSink) writeEntry(entry logEntry) error {
+	slog.Info("tree output", "name", s.name, "stream", entry.stream, "line", string(entry.line))
+	return nil
+}
+
+func (s inheritSink) Close() error {
+	return nil
+}
+
+// socketSink sends each line of output as a datagram to a local logging
+// socket, formatted by encode. If sending fails it reconnects once, so that
+// the logging daemon may restart.
+type socketSink struct {
+	network string
+	address string
+	encode  func(entry logEntry) []byte
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func dialSocketSink(network string, address string, encode func(logEntry) []byte) (*socketSink, error) {
+	s := &socketSink{network: network, address: address, encode: encode}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect dials the socket. A unix socket may be a datagram or a stream
+// socket, the latter gets records ending in a newline. The caller must hold mu
+// or own s.
+func (s *socketSink) connect() error {
+	network := s.network
+	if network == "unix" {
+		network = "unixgram"
+	}
+	conn, err := net.Dial(network, s.address)
+	if err != nil && s.network == "unix" {
+		conn, err = net.Dial("unix", s.address)
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *socketSink) writeEntry(entry logEntry) error {
+	record := s.encode(entry)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.send(record)
+	if err != nil {
+		s.conn.Close()
+		if err = s.connect(); err == nil {
+			err = s.send(record)
+		}
+	}
+	return err
+}
+
+// send writes record to the socket. The caller must hold mu.
+func (s *socketSink) send(record []byte) error {
+	if s.conn.LocalAddr().Network() == "unix" {
+		record = append(record, '\n')
+	}
+	_, err := s.conn.Write(record)
+	return err
+}
+
+func (s *socketSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.Close()
+}
+
+// dialSyslog connects to the syslog socket at addr for the tree name.
+func dialSyslog(name string, addr SyslogAddress) (*socketSink, error) {
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		hostname = "-"
+	}
+	appName := syslogAppName(name)
+	return dialSocketSink(addr.Network, addr.Address, func(entry logEntry) []byte {
+		return encodeSyslog(entry, time.Now(), hostname, appName)
+	})
+}
+
+// encodeSyslog returns the RFC 5424 message of entry, with the stream as its
+// message ID.
+func encodeSyslog(entry logEntry, now time.Time, hostname string, appName string) []byte {
+	procID := "-"
+	if entry.pid > 0 {
+		procID = strconv.Itoa(entry.pid)
+	}
+	header := fmt.Sprintf("<%d>1 %s %s %s %s %s - ", syslogFacility*8+entry.priority(),
+		now.Format("2006-01-02T15:04:05.000000Z07:00"), hostname, appName, procID, entry.stream)
+	return append([]byte(header), entry.line...)
+}
+
+// syslogAppName returns name as an RFC 5424 APP-NAME, which is printable ASCII
+// without spaces.
+func syslogAppName(name string) string {
+	app := []byte{}
+	for _, c := range []byte(name) {
+		if c < '!' || c > '~' {
+			c = '_'
+		}
+		app = append(app, c)
+	}
+	if len(app) == 0 {
+		return "-"
+	}
+	return string(app[:min(len(app), maxSyslogAppLen)])
+}
+
+// dialJournal connects to the native journald socket for the tree name.
+func dialJournal(name string) (*socketSink, error) {
+	return dialSocketSink("unixgram", JournalSocket, func(entry logEntry) []byte {
+		return encodeJournal(entry, name)
+	})
+}
+
+// encodeJournal returns the fields of entry in the native journal protocol.
+func encodeJournal(entry logEntry, name string) []byte {
+	var buf bytes.Buffer
+	field := func(key string, value []byte) {
+		buf.WriteString(key)
+		if bytes.IndexByte(value, '\n') < 0 {
+			buf.WriteByte('=')
+			buf.Write(value)
+		} else {
+			// values with newlines are sent with their length
+			buf.WriteByte('\n')
+			buf.Write(binary.LittleEndian.AppendUint64(nil, uint64(len(value))))
+			buf.Write(value)
+		}
+		buf.WriteByte('\n')
+	}
+	field("MESSAGE", entry.line)
+	field("PRIORITY", []byte(strconv.Itoa(entry.priority())))
+	field("SYSLOG_FACILITY", []byte(strconv.Itoa(syslogFacility)))
+	field("SYSLOG_IDENTIFIER", []byte(name))
+	if entry.pid > 0 {
+		field("SYSLOG_PID", []byte(strconv.Itoa(entry.pid)))
+	}
+	field("PINE_STREAM", []byte(entry.stream))
+	return buf.Bytes()
+}
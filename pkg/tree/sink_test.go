@@ -0,0 +1,87 @@
+package tree_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+// readDatagrams reads n datagrams from conn, sorted.
+func readDatagrams(t *testing.T, conn net.PacketConn, n int) []string {
+	noErr(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	received := []string{}
+	buf := make([]byte, 8192)
+	for range n {
+		size, _, err := conn.ReadFrom(buf)
+		noErr(t, err)
+		received = append(received, string(buf[:size]))
+	}
+	slices.Sort(received)
+	return received
+}
+
+func TestSyslogOutput(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "syslog.sock")
+	unixConn, err := net.ListenPacket("unixgram", sockPath)
+	noErr(t, err)
+	defer unixConn.Close()
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	noErr(t, err)
+	defer udpConn.Close()
+
+	for _, tc := range []struct {
+		address string
+		conn    net.PacketConn
+	}{
+		{"unix " + sockPath, unixConn},
+		{"udp " + udpConn.LocalAddr().String(), udpConn},
+	} {
+		treeImpl, err := tree.NewTree(createTreeFile(t, "Name Syslog\nShell yes\nStandardOutput syslog\nStandardError syslog\n"+
+			"SyslogAddress "+tc.address+"\nCommand echo hello; echo oops >&2\n"))
+		noErr(t, err)
+		noErr(t, treeImpl.Start(context.Background()))
+
+		received := readDatagrams(t, tc.conn, 2)
+		for i, want := range []*regexp.Regexp{
+			regexp.MustCompile(`^<27>1 \S+ \S+ Syslog \d+ stderr - oops$`),
+			regexp.MustCompile(`^<30>1 \S+ \S+ Syslog \d+ stdout - hello$`),
+		} {
+			if !want.MatchString(received[i]) {
+				t.Errorf("%s: unexpected message %q", tc.address, received[i])
+			}
+		}
+	}
+}
+
+func TestJournalOutput(t *testing.T) {
+	defer func(socket string) { tree.JournalSocket = socket }(tree.JournalSocket)
+	tree.JournalSocket = filepath.Join(t.TempDir(), "journal.sock")
+	conn, err := net.ListenPacket("unixgram", tree.JournalSocket)
+	noErr(t, err)
+	defer conn.Close()
+
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Journal\nShell yes\nStandardOutput journal\nStandardError journal\n"+
+		"Command echo hello; echo oops >&2\n"))
+	noErr(t, err)
+	noErr(t, treeImpl.Start(context.Background()))
+
+	received := readDatagrams(t, conn, 2)
+	for i, want := range [][]string{
+		{"MESSAGE=hello", "PRIORITY=6", "SYSLOG_IDENTIFIER=Journal", "PINE_STREAM=stdout"},
+		{"MESSAGE=oops", "PRIORITY=3", "SYSLOG_IDENTIFIER=Journal", "PINE_STREAM=stderr"},
+	} {
+		fields := strings.Split(strings.TrimSuffix(received[i], "\n"), "\n")
+		for _, field := range want {
+			if !slices.Contains(fields, field) {
+				t.Errorf("expected %s in %q", field, fields)
+			}
+		}
+	}
+}
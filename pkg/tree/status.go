@@ -6,14 +6,55 @@ type Status struct {
 	For *Config
 
 	State      State
+	StatusText string
 	LastChange time.Time
 	Uptime     time.Duration
+
+	Pid         int
+	RunCount    int
+	ExitCode    int
+	ExitSignal  string
+	ExitReason  ExitReason
+	Health      Health
+	LastError   string
+	LastOutput  []string // the last lines of output
+	Limits      []Limit  // the effective limits of the main process
+	NextRestart time.Time
+
+	// Cgroup is the tree's cgroup, empty without cgroups. Usage is its
+	// accounting, which is kept after the tree exits.
+	Cgroup string
+	Usage  ResourceUsage
+
+	// Enabled tells whether the daemon starts the tree when it is loaded.
+	Enabled bool
+	// NextRun and LastRun are the next and last runs of a scheduled tree.
+	NextRun time.Time
+	LastRun time.Time
 }
 
 type State string
 
 const (
+	StartingState   State = "starting"
 	RunningState    State = "running"
+	StoppingState   State = "stopping"
 	StoppedState    State = "stopped"
 	RestartingState State = "restarting"
+	CrashLoopState  State = "crashloop"
+	SucceededState  State = "succeeded" // oneshot tree exited cleanly
+	FailedState     State = "failed"    // oneshot tree exited with an error
+)
+
+// ExitReason describes how the last run of a tree ended.
+type ExitReason string
+
+const (
+	ExitedReason    ExitReason = "exited"    // exited on its own
+	SignaledReason  ExitReason = "signaled"  // terminated by a signal pine did not send
+	StoppedReason   ExitReason = "stopped"   // exited after receiving the stop signal
+	KilledReason    ExitReason = "killed"    // killed after the stop timeout passed
+	UnhealthyReason ExitReason = "unhealthy" // stopped for a restart after failing health checks
+	TimeoutReason   ExitReason = "timeout"   // stopped after not becoming ready within the start timeout
+	WatchdogReason  ExitReason = "watchdog"  // stopped for a restart after missing a watchdog ping
 )
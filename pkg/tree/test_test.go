@@ -1,8 +1,13 @@
 package tree_test
 
 import (
+	"bytes"
 	"log/slog"
+	"os"
+	"os/user"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -14,3 +19,29 @@ func noErr(t *testing.T, err error) {
 		t.Error(err.Error())
 	}
 }
+
+// createTreeFile writes a tree config that runs as the current user and logs
+// into a temporary directory.
+func createTreeFile(t *testing.T, contents string) string {
+	dir := t.TempDir()
+	currUser, err := user.Current()
+	noErr(t, err)
+	filename := filepath.Join(dir, "test.tree")
+	contents += "User " + currUser.Username + "\nLogFile " + filepath.Join(dir, "test.log") + "\n"
+	noErr(t, os.WriteFile(filename, []byte(contents), 0644))
+	return filename
+}
+
+// readLog returns the contents of the log file at filename once it has at
+// least lines lines. Output is still copied for a moment after a tree exits.
+func readLog(t *testing.T, filename string, lines int) []byte {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, err := os.ReadFile(filename)
+		if (err == nil && bytes.Count(data, []byte{'\n'}) >= lines) || time.Now().After(deadline) {
+			noErr(t, err)
+			return data
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
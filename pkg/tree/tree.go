@@ -1,15 +1,16 @@
 package tree
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"os/user"
+	"slices"
 	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -22,8 +23,11 @@ type Tree interface {
 	Restart(ctx context.Context) error
 	Destroy(ctx context.Context) error
 	RotateLog() error
+	RecentOutput() []string
+	Logs(ctx context.Context, opts LogOptions) (io.ReadCloser, error)
 	Config() Config
 	Reload(ctx context.Context) error
+	Adopt(a Adoption) error
 }
 
 type TreeImpl struct {
@@ -33,11 +37,29 @@ type TreeImpl struct {
 	stateMu       sync.Mutex
 	stopChan      chan bool
 	fullStop      bool
+	restartReq    bool
 	runCount      int
 	currState     State
 	startedAt     time.Time
 	lastChangedAt time.Time
-	logger        *RotatingFileWriter
+	pid           int
+	pgid          int
+	cgroup        string
+	running       bool // Start has not returned yet
+	destroyed     bool
+	statusText    string
+	exitCode      int
+	exitSignal    string
+	exitReason    ExitReason
+	health        Health
+	lastErr       error
+	nextRestart   time.Time
+	adoption      *Adoption
+	runOutput     *runOutput
+
+	outputMu  sync.Mutex
+	output    *outputBuffer
+	followers map[chan []byte]bool
 }
 
 var _ Tree = (*TreeImpl)(nil)
@@ -55,6 +77,7 @@ func NewTree(cfgFile string) (*TreeImpl, error) {
 		runCount:      0,
 		currState:     StoppedState,
 		lastChangedAt: time.Now(),
+		output:        newOutputBuffer(cfg.OutputBufferLines),
 	}, nil
 }
 
@@ -62,119 +85,478 @@ func (t *TreeImpl) Start(ctx context.Context) error {
 	var err error
 
 	t.configMu.RLock()
-	restartMode := t.config.Restart
-	restartAttempts := t.config.RestartAttempts
-	restartDelay := t.config.RestartDelay
 	name := t.config.Name
 	t.configMu.RUnlock()
 
 	t.stateMu.Lock()
 	t.fullStop = false
+	t.restartReq = false
 	t.runCount = 0
+	t.running = true
+	adoption := t.adoption
+	t.adoption = nil
 	t.stateMu.Unlock()
+	defer t.endRun()
 
+	// drop any stop request left over from a previous run
+	select {
+	case <-t.stopChan:
+	default:
+	}
+
+	var restartDelay time.Duration
+	restarts := []time.Time{}
 	for {
 		t.stateMu.Lock()
 		if t.fullStop {
-			t.currState = StoppedState
+			t.setState(StoppedState)
 			t.stateMu.Unlock()
 			return err
 		}
-		t.currState = RestartingState
 		runCount := t.runCount
+		if runCount > 0 {
+			t.setState(RestartingState)
+			t.nextRestart = time.Now().Add(restartDelay)
+		}
 		t.stateMu.Unlock()
 
-		if runCount > 0 {
-			timer := time.NewTimer(restartDelay)
-			select {
-			case <-timer.C:
-			case <-ctx.Done():
-				return nil
-			}
+		if runCount > 0 && !t.waitRestart(ctx, restartDelay) {
+			t.stateMu.Lock()
+			t.nextRestart = time.Time{}
+			t.setState(StoppedState)
+			t.stateMu.Unlock()
+			return err
 		}
 		slog.Info("starting tree", "name", name)
-		ctx, cancel := context.WithCancel(ctx)
-		defer cancel()
 
 		t.configMu.RLock()
-		cmd := t.config.Command
-		envFile := t.config.EnvironmentFile
-		user := t.config.User
-		logFile := t.config.LogFile
-		maxLogAge := t.config.MaxLogAge
+		cfg := t.config
 		t.configMu.RUnlock()
 
-		errChan := make(chan error)
-		go t.run(ctx, cmd, envFile, user, logFile, maxLogAge, errChan)
-		err = t.runWait(cancel, errChan)
-		close(errChan)
+		runStart := time.Now()
+		var proc *process
+		var reason ExitReason
+		if adoption != nil {
+			if proc, err = t.adopt(cfg, *adoption); err != nil {
+				slog.Warn("failed to adopt tree, starting it again", "name", name, "pid", adoption.Pid, "err", err)
+			}
+			adoption = nil
+		}
+		if proc == nil {
+			proc, err = t.spawn(cfg)
+		}
+		if err == nil {
+			reason, err = t.runWait(ctx, proc, cfg)
+			if err != nil && !exitClean(cfg, err) {
+				err = t.withOutput(proc, err)
+			}
+		}
+		uptime := time.Since(runStart)
 
 		t.stateMu.Lock()
-		currentRunCount := t.runCount
-		shouldStop := t.fullStop || (restartMode == NeverRestart) || (restartMode == LimitedRestart && currentRunCount >= restartAttempts)
+		t.nextRestart = time.Time{}
+		if err != nil {
+			t.lastErr = err
+		}
+		restart := t.restartReq || shouldRestart(cfg, reason, err, t.runCount)
+		t.restartReq = false
+		manualStop := t.fullStop || ctx.Err() != nil
+		shouldStop := manualStop || !restart
+		finalState := StoppedState
+		if shouldStop && cfg.Type == OneshotType && !manualStop {
+			finalState = FailedState
+			if exitClean(cfg, err) {
+				finalState = SucceededState
+			}
+		}
+		if shouldStop {
+			t.setState(finalState)
+		}
 		t.stateMu.Unlock()
 
-		if shouldStop {
+		if shouldStop && finalState == SucceededState && cfg.RemainAfterExit {
+			if t.remainAfterExit(ctx) {
+				restartDelay = 0
+				continue
+			}
 			t.stateMu.Lock()
-			t.currState = StoppedState
+			t.setState(StoppedState)
 			t.stateMu.Unlock()
 			return err
+		} else if shouldStop {
+			return err
+		}
+
+		if cfg.RestartLimitBurst > 0 {
+			now := time.Now()
+			restarts = slices.DeleteFunc(append(restarts, now), func(ts time.Time) bool {
+				return now.Sub(ts) > cfg.RestartLimitInterval
+			})
+			if len(restarts) > cfg.RestartLimitBurst {
+				err = fmt.Errorf("crash loop: %d restarts within %s: %w", len(restarts), cfg.RestartLimitInterval, err)
+				slog.Warn("tree is crash looping", "name", name, "restarts", len(restarts), "interval", cfg.RestartLimitInterval)
+				t.stateMu.Lock()
+				t.lastErr = err
+				t.setState(CrashLoopState)
+				t.stateMu.Unlock()
+				return err
+			}
 		}
+		restartDelay = nextRestartDelay(cfg, restartDelay, uptime)
 	}
 }
 
-func (t *TreeImpl) run(ctx context.Context, cmd string, envFile string, user string, logFile string, maxLogAge int, errChan chan error) {
+// endRun marks that Start returned, removing the tree's cgroup if the tree was
+// destroyed meanwhile.
+func (t *TreeImpl) endRun() {
 	t.stateMu.Lock()
-	t.runCount++
+	t.running = false
+	destroyed := t.destroyed
+	cgroup := t.cgroup
 	t.stateMu.Unlock()
+	if destroyed && len(cgroup) > 0 {
+		removeCgroup(cgroup, cgroupDrainTimeout)
+	}
+}
+
+// waitRestart waits out the delay before the next restart. It returns false
+// if the tree should stop instead, and returns early on a restart request.
+func (t *TreeImpl) waitRestart(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-t.stopChan:
+		t.stateMu.Lock()
+		defer t.stateMu.Unlock()
+		t.restartReq = false
+		return !t.fullStop
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// remainAfterExit keeps a oneshot tree that succeeded active until it is
+// stopped. It returns true if the tree should run again instead.
+func (t *TreeImpl) remainAfterExit(ctx context.Context) bool {
+	select {
+	case <-t.stopChan:
+		t.stateMu.Lock()
+		defer t.stateMu.Unlock()
+		t.restartReq = false
+		return !t.fullStop
+	case <-ctx.Done():
+		return false
+	}
+}
 
-	commandParts := strings.Split(cmd, " ")
-	args := []string{}
-	if len(commandParts) > 1 {
-		args = commandParts[1:]
+// shouldRestart applies the tree's restart policy to a run that ended with
+// reason and err. Runs that failed to start have an empty reason.
+func shouldRestart(cfg Config, reason ExitReason, err error, runCount int) bool {
+	switch cfg.Restart {
+	case AlwaysRestart:
+		return true
+	case LimitedRestart:
+		return runCount < cfg.RestartAttempts
+	case OnFailureRestart:
+		return !exitClean(cfg, err)
+	case OnSuccessRestart:
+		return exitClean(cfg, err)
+	case OnAbnormalRestart:
+		switch reason {
+		case KilledReason, TimeoutReason, WatchdogReason:
+			return true
+		case SignaledReason:
+			return !exitClean(cfg, err)
+		}
+	}
+	return false
+}
+
+// cleanSignals are the signals a process may die from and still count as a
+// clean exit, matching systemd.
+var cleanSignals = []syscall.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE}
+
+// exitClean reports whether a run that ended with err counts as successful:
+// exit code 0, a clean signal, or a status listed in SuccessExitStatus.
+func exitClean(cfg Config, err error) bool {
+	if err == nil {
+		return true
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return false
 	}
-	execCmd := exec.CommandContext(ctx, commandParts[0], args...)
-	if err := t.setCmdSysProcAttr(execCmd, user); err != nil {
-		errChan <- err
+	if status.Signaled() {
+		return slices.Contains(cleanSignals, status.Signal()) || slices.Contains(cfg.SuccessExitSignals, status.Signal())
+	}
+	return slices.Contains(cfg.SuccessExitStatus, status.ExitStatus())
+}
+
+// nextRestartDelay grows the previous delay by the backoff multiplier, up to
+// the maximum delay. The delay starts over once a run stays up long enough.
+func nextRestartDelay(cfg Config, prev time.Duration, uptime time.Duration) time.Duration {
+	if prev == 0 || uptime >= cfg.RestartResetAfter {
+		return cfg.RestartDelay
+	}
+	next := time.Duration(float64(prev) * cfg.RestartBackoff)
+	if cfg.RestartMaxDelay > 0 && next > cfg.RestartMaxDelay {
+		next = cfg.RestartMaxDelay
+	}
+	return next
+}
+
+// setState moves the tree to state, recording when the state last changed.
+// The caller must hold stateMu.
+func (t *TreeImpl) setState(state State) {
+	if t.currState == state {
 		return
 	}
-	if len(envFile) > 0 {
-		envVars, err := t.loadEnvFile(envFile)
+	t.currState = state
+	t.lastChangedAt = time.Now()
+}
+
+func (t *TreeImpl) spawn(cfg Config) (*process, error) {
+	t.stateMu.Lock()
+	t.runCount++
+	runCount := t.runCount
+	t.stateMu.Unlock()
+
+	envVars, err := t.environment(cfg)
+	if err != nil {
+		return nil, err
+	}
+	args, err := commandArgs(cfg, envVars)
+	if err != nil {
+		return nil, err
+	}
+
+	proc := &process{
+		env:        envVars,
+		ready:      make(chan struct{}),
+		watchdog:   make(chan struct{}, 1),
+		outputDone: make(chan struct{}),
+	}
+	if cfg.Type == NotifyType || cfg.WatchdogSec > 0 {
+		if proc.notify, err = listenNotify(cfg.Name); err != nil {
+			return nil, fmt.Errorf("failed to create notify socket: %w", err)
+		}
+		envVars = append(slices.Clip(envVars), "NOTIFY_SOCKET="+proc.notify.path)
+	}
+	closeNotify := func() {
+		if proc.notify != nil {
+			proc.notify.Close()
+		}
+	}
+
+	// WATCHDOG_PID must be the main process's pid, which is only known once it
+	// runs, so the exec helper sets it.
+	var opts helperOptions
+	if cfg.WatchdogSec > 0 {
+		envVars = append(envVars, fmt.Sprintf("WATCHDOG_USEC=%d", cfg.WatchdogSec.Microseconds()))
+		opts.WatchdogPid = true
+	}
+	if cfg.UMask >= 0 {
+		opts.UMask = &cfg.UMask
+	}
+	opts.Limits = cfg.Limits
+
+	// The tree starts right in its cgroup, so that none of its processes can
+	// escape it.
+	if proc.cgroup, err = treeCgroup(cfg); err != nil {
+		closeNotify()
+		return nil, err
+	}
+	var cgroupDir *os.File
+	if len(proc.cgroup) > 0 {
+		if cgroupDir, err = os.Open(proc.cgroup); err != nil {
+			closeNotify()
+			return nil, err
+		}
+		defer cgroupDir.Close()
+	}
+	execCmd, err := t.command(cfg, args, envVars, opts, cgroupDir)
+	if err != nil {
+		closeNotify()
+		return nil, err
+	}
+
+	// Output goes through pipes owned by pine rather than ones managed by
+	// exec, so waiting for the main process does not block on descendants
+	// that still hold the write ends.
+	var readers, writers []*os.File
+	closePipes := func() {
+		for _, f := range slices.Concat(readers, writers) {
+			f.Close()
+		}
+	}
+	for range 2 {
+		r, w, err := os.Pipe()
 		if err != nil {
-			errChan <- err
-			return
+			closePipes()
+			closeNotify()
+			return nil, err
 		}
-		execCmd.Env = envVars
+		readers = append(readers, r)
+		writers = append(writers, w)
 	}
-	var err error
-	t.logger, err = NewRotatingFileWriter(logFile, maxLogAge)
+	execCmd.Stdout = writers[0]
+	execCmd.Stderr = writers[1]
+
+	out := t.openOutput(cfg)
+	err = execCmd.Start()
+	if err != nil && execCmd.SysProcAttr.UseCgroupFD && cloneUnsupported(err) {
+		if execCmd, err = t.command(cfg, args, envVars, opts, cgroupDir); err == nil {
+			execCmd.Stdout = writers[0]
+			execCmd.Stderr = writers[1]
+			err = execCmd.Start()
+		}
+	}
+	for _, w := range writers {
+		w.Close()
+	}
+	writers = nil
 	if err != nil {
-		errChan <- err
-		return
+		closePipes()
+		out.close()
+		closeNotify()
+		return nil, err
 	}
-	defer t.logger.Close()
-	execCmd.Stdout = t.logger
-	execCmd.Stderr = t.logger
+	proc.cmd = execCmd
+	proc.pid = execCmd.Process.Pid
+	proc.pgid = proc.pid
+	if err := startHolder(proc.pid, readers); err != nil {
+		slog.Warn("failed to start output holder, output is lost if pine restarts", "name", cfg.Name, "err", err)
+	}
+	t.outputMu.Lock()
+	proc.outputMark = t.output.added
+	t.outputMu.Unlock()
+	out.setProcess(proc.pid, runCount)
+	go t.copyOutput(readers, out, proc.outputDone)
 
 	t.stateMu.Lock()
+	t.runOutput = out
+	t.pid = proc.pid
+	t.pgid = proc.pgid
+	t.cgroup = proc.cgroup
+	t.statusText = ""
 	t.startedAt = time.Now()
-	t.currState = RunningState
+	if cfg.Type == SimpleType {
+		t.setState(RunningState)
+		proc.markReady()
+	} else {
+		t.setState(StartingState)
+	}
 	t.stateMu.Unlock()
 
-	errChan <- execCmd.Run()
+	if proc.notify != nil {
+		go proc.notify.serve(func(pid int, fields map[string]string) {
+			t.handleNotify(proc, cfg, pid, fields)
+		})
+	}
+	return proc, nil
 }
 
-func (t *TreeImpl) setCmdSysProcAttr(cmd *exec.Cmd, targetUser string) error {
-	currUser, err := user.Current()
-	if err != nil || currUser.Username == targetUser {
+// withOutput adds the last output of proc to the error its run failed with.
+// Output still in the pipe is given a moment to arrive.
+func (t *TreeImpl) withOutput(proc *process, err error) error {
+	timer := time.NewTimer(outputDrainTimeout)
+	defer timer.Stop()
+	select {
+	case <-proc.outputDone:
+	case <-timer.C:
+	}
+	t.outputMu.Lock()
+	lines := t.output.linesSince(proc.outputMark, outputTailLines)
+	t.outputMu.Unlock()
+	if len(lines) == 0 {
 		return err
 	}
+	return &outputError{err: err, output: lines}
+}
 
-	// Look up the user details
-	u, err := user.Lookup(targetUser)
+func (t *TreeImpl) RecentOutput() []string {
+	t.outputMu.Lock()
+	defer t.outputMu.Unlock()
+	return t.output.Lines(0)
+}
+
+// commandArgs returns the argv for cfg, either split from the command line
+// with env used for variable expansion or wrapped in /bin/sh when the tree
+// runs its command through the shell.
+func commandArgs(cfg Config, env []string) ([]string, error) {
+	if cfg.Shell {
+		return []string{"/bin/sh", "-c", cfg.Command}, nil
+	}
+	args, err := SplitCommand(cfg.Command, lookupEnv(env))
+	if err != nil {
+		return nil, fmt.Errorf("invalid command: %w", err)
+	}
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return args, nil
+}
+
+// command returns the command that runs the tree, through the exec helper if
+// its process needs setup that exec cannot do. The process starts in the cgroup
+// opened as cgroup, if any.
+func (t *TreeImpl) command(cfg Config, args []string, env []string, opts helperOptions, cgroup *os.File) (*exec.Cmd, error) {
+	if cgroup != nil && !cloneIntoCgroup() {
+		opts.Cgroup = cgroup.Name()
+	}
+	execCmd := exec.Command(args[0], args[1:]...)
+	execCmd.Env = env
+	if err := t.setCmdSysProcAttr(execCmd, cfg); err != nil {
+		return nil, err
+	}
+	if opts.needed() {
+		// The helper changes to the tree's user itself, after setting limits
+		// and joining the cgroup, which may need pine's privileges.
+		opts.Credential = execCmd.SysProcAttr.Credential
+		sysProcAttr := execCmd.SysProcAttr
+		sysProcAttr.Credential = nil
+		var err error
+		if execCmd, err = helperCommand(args, env, opts); err != nil {
+			return nil, err
+		}
+		execCmd.SysProcAttr = sysProcAttr
+	}
+	execCmd.Dir = cfg.WorkingDirectory
+	if cgroup != nil && len(opts.Cgroup) == 0 {
+		execCmd.SysProcAttr.UseCgroupFD = true
+		execCmd.SysProcAttr.CgroupFD = int(cgroup.Fd())
+	}
+	return execCmd, nil
+}
+
+func (t *TreeImpl) setCmdSysProcAttr(cmd *exec.Cmd, cfg Config) error {
+	// Each tree gets its own process group so that stopping it can reach the
+	// processes it forked as well.
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+
+	currUser, err := user.Current()
 	if err != nil {
 		return err
 	}
+	if currUser.Username == cfg.User && len(cfg.Group) == 0 && len(cfg.SupplementaryGroups) == 0 {
+		return nil
+	}
+
+	// Look up the user details
+	u := currUser
+	if currUser.Username != cfg.User {
+		if u, err = user.Lookup(cfg.User); err != nil {
+			return err
+		}
+	}
 
 	uid, err := strconv.Atoi(u.Uid)
 	if err != nil {
@@ -185,47 +567,311 @@ func (t *TreeImpl) setCmdSysProcAttr(cmd *exec.Cmd, targetUser string) error {
 	if err != nil {
 		return fmt.Errorf("failed to parse GID: %w", err)
 	}
+	if len(cfg.Group) > 0 {
+		if gid, err = lookupGroup(cfg.Group); err != nil {
+			return err
+		}
+	}
 
-	// Set the SysProcAttr to run as the target user
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Credential: &syscall.Credential{
-			Uid: uint32(uid),
-			Gid: uint32(gid),
-		},
+	// Keep the user's supplementary groups, which would otherwise be dropped
+	// when changing to the user.
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return fmt.Errorf("failed to look up groups of %s: %w", u.Username, err)
+	}
+	groups := []uint32{}
+	for _, groupId := range groupIds {
+		id, err := strconv.Atoi(groupId)
+		if err != nil {
+			return fmt.Errorf("failed to parse GID: %w", err)
+		}
+		groups = append(groups, uint32(id))
+	}
+	for _, group := range cfg.SupplementaryGroups {
+		id, err := lookupGroup(group)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, uint32(id))
+	}
+
+	// Run as the target user
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    uint32(uid),
+		Gid:    uint32(gid),
+		Groups: groups,
 	}
 	return nil
 }
 
-func (t *TreeImpl) runWait(cancel context.CancelFunc, errChan chan error) error {
+// lookupGroup returns the ID of a group given by name or ID.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.Atoi(g.Gid)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse GID: %w", err)
+	}
+	return gid, nil
+}
+
+// runWait waits for the tree's main process to exit. A stop request or
+// cancelled context sends the configured stop signal, and the tree is killed
+// if it is still running once the stop timeout passes. Notify and forking
+// trees are stopped if they do not finish starting within the start timeout,
+// and trees with a watchdog are restarted once they stop sending pings.
+func (t *TreeImpl) runWait(ctx context.Context, proc *process, cfg Config) (ExitReason, error) {
+	cmd := proc.cmd
+	if proc.notify != nil {
+		defer proc.notify.Close()
+	}
+
+	// A forking tree's main process is the one named in its pid file once
+	// the process pine started exits, so it is adopted and polled instead.
+	// Processes adopted from a previous pine are polled as well.
+	waitChan := make(chan exitResult, 1)
+	adoptChan := make(chan int, 1)
+	go func() {
+		if cmd == nil {
+			waitForExit(proc.pid)
+			waitChan <- exitResult{}
+			return
+		}
+		err := cmd.Wait()
+		if cfg.Type != ForkingType || err != nil {
+			waitChan <- exitResult{state: cmd.ProcessState, err: err}
+			return
+		}
+		mainPid, err := readPIDFile(cfg.PIDFile)
+		if err != nil {
+			waitChan <- exitResult{err: fmt.Errorf("failed to read pid file: %w", err)}
+			return
+		}
+		adoptChan <- mainPid
+		waitForExit(mainPid)
+		waitChan <- exitResult{}
+	}()
+
+	unhealthyChan := make(chan struct{}, 1)
+	if len(cfg.HealthCheck.Type) > 0 {
+		healthCtx, cancelHealth := context.WithCancel(ctx)
+		defer cancelHealth()
+		go t.watchHealth(healthCtx, cfg, proc.env, unhealthyChan)
+	}
+
+	var startChan <-chan time.Time
+	if cfg.Type == NotifyType || cfg.Type == ForkingType {
+		startTimer := time.NewTimer(cfg.StartTimeout)
+		defer startTimer.Stop()
+		startChan = startTimer.C
+	}
+
+	// the watchdog starts once the tree is ready
+	var readyChan <-chan struct{}
+	var watchdogTimer *time.Timer
+	var watchdogChan <-chan time.Time
+	if cfg.WatchdogSec > 0 {
+		readyChan = proc.ready
+		defer func() {
+			if watchdogTimer != nil {
+				watchdogTimer.Stop()
+			}
+		}()
+	}
+
+	pid := proc.pid
+	pgid := proc.pgid
+	cgroup := proc.cgroup
+	// Destroy closes the stop channel, which must not be received again
+	stopChan := t.stopChan
+	ctxDone := ctx.Done()
+	stopping := false
+	unhealthy := false
+	timedOut := false
+	watchdogExpired := false
+	var failure error // why pine stopped the tree, reported instead of its exit
+	killed := false
+	var killTimer *time.Timer
+	var killChan <-chan time.Time
+	defer func() {
+		if killTimer != nil {
+			killTimer.Stop()
+		}
+	}()
+
+	stop := func() {
+		if stopping {
+			return
+		}
+		stopping = true
+		t.stateMu.Lock()
+		t.setState(StoppingState)
+		t.stateMu.Unlock()
+		slog.Debug("sending stop signal", "name", cfg.Name, "signal", cfg.StopSignal, "killMode", cfg.KillMode)
+		if err := signalTree(pid, pgid, cgroup, cfg.KillMode, cfg.StopSignal); err != nil {
+			slog.Warn("failed to send stop signal", "name", cfg.Name, "err", err)
+		}
+		killTimer = time.NewTimer(cfg.StopTimeout)
+		killChan = killTimer.C
+	}
+
 	for {
 		select {
-		case <-t.stopChan:
-			cancel()
-		case err := <-errChan:
-			return err
+		case <-stopChan:
+			stopChan = nil
+			stop()
+		case <-ctxDone:
+			ctxDone = nil
+			stop()
+		case <-unhealthyChan:
+			if stopping {
+				continue
+			}
+			slog.Warn("restarting unhealthy tree", "name", cfg.Name)
+			t.stateMu.Lock()
+			t.restartReq = true
+			t.stateMu.Unlock()
+			unhealthy = true
+			stop()
+		case <-readyChan:
+			readyChan = nil
+			watchdogTimer = time.NewTimer(cfg.WatchdogSec)
+			watchdogChan = watchdogTimer.C
+		case <-proc.watchdog:
+			if watchdogTimer != nil {
+				watchdogTimer.Reset(cfg.WatchdogSec)
+			}
+		case <-watchdogChan:
+			watchdogChan = nil
+			if stopping {
+				continue
+			}
+			slog.Warn("tree missed its watchdog, restarting", "name", cfg.Name, "interval", cfg.WatchdogSec)
+			t.stateMu.Lock()
+			t.restartReq = true
+			t.stateMu.Unlock()
+			failure = fmt.Errorf("no watchdog ping within %s", cfg.WatchdogSec)
+			watchdogExpired = true
+			stop()
+		case <-startChan:
+			startChan = nil
+			select {
+			case <-proc.ready:
+				continue
+			default:
+			}
+			if stopping {
+				continue
+			}
+			slog.Warn("tree did not start in time, stopping", "name", cfg.Name, "timeout", cfg.StartTimeout)
+			failure = fmt.Errorf("tree did not become ready within %s", cfg.StartTimeout)
+			timedOut = true
+			stop()
+		case mainPid := <-adoptChan:
+			pid = mainPid
+			if pgid = processGroup(mainPid); pgid == 0 {
+				pgid = mainPid
+			}
+			slog.Debug("adopted main process", "name", cfg.Name, "pid", pid, "pgid", pgid)
+			t.stateMu.Lock()
+			t.pid = pid
+			t.pgid = pgid
+			if !stopping {
+				t.setState(RunningState)
+			}
+			t.stateMu.Unlock()
+			proc.markReady()
+			if stopping {
+				// the stop signal went to the parent before the tree forked
+				signalTree(pid, pgid, cgroup, cfg.KillMode, cfg.StopSignal)
+			}
+		case <-killChan:
+			killChan = nil
+			slog.Warn("tree did not stop in time, killing", "name", cfg.Name, "timeout", cfg.StopTimeout)
+			killed = true
+			if err := signalTree(pid, pgid, cgroup, cfg.KillMode, syscall.SIGKILL); err != nil {
+				slog.Warn("failed to kill tree", "name", cfg.Name, "err", err)
+			}
+		case res := <-waitChan:
+			reason := ExitedReason
+			exitCode := -1
+			exitSignal := ""
+			if res.state != nil {
+				exitCode = res.state.ExitCode()
+				if status, ok := res.state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+					reason = SignaledReason
+					exitSignal = signalName(status.Signal())
+				}
+			}
+			if killed {
+				reason = KilledReason
+			} else if timedOut {
+				reason = TimeoutReason
+			} else if watchdogExpired {
+				reason = WatchdogReason
+			} else if unhealthy {
+				reason = UnhealthyReason
+			} else if stopping {
+				reason = StoppedReason
+			}
+
+			t.stateMu.Lock()
+			t.pid = 0
+			t.pgid = 0
+			t.health = UnknownHealth
+			t.exitCode = exitCode
+			t.exitSignal = exitSignal
+			t.exitReason = reason
+			t.stateMu.Unlock()
+
+			t.reapGroup(pgid, cgroup, cfg, stopping, killChan)
+			if failure != nil {
+				return reason, failure
+			}
+			return reason, res.err
 		}
 	}
 }
 
-func (t *TreeImpl) loadEnvFile(filename string) ([]string, error) {
-	res := []string{}
-	fp, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+// reapGroup stops the processes left in the tree's process group, or its
+// cgroup, after its main process exited. In group mode they get the stop
+// signal and are killed once the stop timeout passes, in mixed mode they are
+// killed right away.
+func (t *TreeImpl) reapGroup(pgid int, cgroup string, cfg Config, stopping bool, killChan <-chan time.Time) {
+	if cfg.KillMode == ProcessKillMode || !treeAlive(pgid, cgroup) {
+		return
+	}
+	if cfg.KillMode == MixedKillMode || (stopping && killChan == nil) {
+		signalTree(pgid, pgid, cgroup, MixedKillMode, syscall.SIGKILL)
+		return
+	}
+	if !stopping {
+		slog.Debug("stopping remaining processes", "name", cfg.Name)
+		signalTree(pgid, pgid, cgroup, GroupKillMode, cfg.StopSignal)
+		killTimer := time.NewTimer(cfg.StopTimeout)
+		defer killTimer.Stop()
+		killChan = killTimer.C
 	}
-	defer fp.Close()
 
-	scanner := bufio.NewScanner(fp)
-	lineNum := 0
-	for scanner.Scan() {
-		lineNum++
-		line := scanner.Text()
-		if !strings.Contains(line, "=") {
-			return nil, fmt.Errorf("invalid environment file format on line %d", lineNum)
+	ticker := time.NewTicker(groupPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-killChan:
+			slog.Warn("remaining processes did not stop in time, killing", "name", cfg.Name)
+			signalTree(pgid, pgid, cgroup, GroupKillMode, syscall.SIGKILL)
+			return
+		case <-ticker.C:
+			if !treeAlive(pgid, cgroup) {
+				return
+			}
 		}
-		res = append(res, line)
 	}
-	return res, nil
 }
 
 func (t *TreeImpl) Stop(ctx context.Context) error {
@@ -248,25 +894,51 @@ func (t *TreeImpl) Status(ctx context.Context) (*Status, error) {
 	cfg := t.config
 	t.configMu.RUnlock()
 
+	t.outputMu.Lock()
+	lastOutput := t.output.Lines(outputTailLines)
+	t.outputMu.Unlock()
+
 	t.stateMu.Lock()
-	currState := t.currState
-	startedAt := t.startedAt
-	lastChangedAt := t.lastChangedAt
+	status := &Status{
+		For:         &cfg,
+		LastOutput:  lastOutput,
+		State:       t.currState,
+		StatusText:  t.statusText,
+		Uptime:      0,
+		LastChange:  t.lastChangedAt,
+		Pid:         t.pid,
+		RunCount:    t.runCount,
+		ExitCode:    t.exitCode,
+		ExitSignal:  t.exitSignal,
+		ExitReason:  t.exitReason,
+		Health:      t.health,
+		NextRestart: t.nextRestart,
+	}
+	if t.lastErr != nil {
+		status.LastError = t.lastErr.Error()
+	}
+	if t.pid != 0 {
+		status.Uptime = time.Since(t.startedAt)
+	}
+	pid := t.pid
+	status.Cgroup = t.cgroup
 	t.stateMu.Unlock()
 
-	status := &Status{
-		For:        &cfg,
-		State:      currState,
-		Uptime:     0,
-		LastChange: lastChangedAt,
+	if pid != 0 && len(cfg.Limits) > 0 {
+		// the process may have just exited, leaving no limits to show
+		status.Limits, _ = processLimits(pid, cfg.Limits)
 	}
-	if currState == RunningState {
-		status.Uptime = time.Since(startedAt)
+	if len(status.Cgroup) > 0 {
+		status.Usage = cgroupUsage(status.Cgroup)
 	}
+
 	return status, nil
 }
 
 func (t *TreeImpl) Restart(ctx context.Context) error {
+	t.stateMu.Lock()
+	t.restartReq = true
+	t.stateMu.Unlock()
 	select {
 	case t.stopChan <- true:
 	default:
@@ -277,6 +949,15 @@ func (t *TreeImpl) Restart(ctx context.Context) error {
 func (t *TreeImpl) Destroy(ctx context.Context) error {
 	err := t.Stop(ctx)
 	close(t.stopChan)
+	t.stateMu.Lock()
+	t.destroyed = true
+	running := t.running
+	cgroup := t.cgroup
+	t.stateMu.Unlock()
+	// a running tree removes its cgroup once it stopped
+	if !running && len(cgroup) > 0 {
+		removeCgroup(cgroup, 0)
+	}
 	return err
 }
 
@@ -287,8 +968,11 @@ func (t *TreeImpl) Config() Config {
 }
 
 func (t *TreeImpl) RotateLog() error {
-	if t.logger != nil {
-		return t.logger.Rotate()
+	t.stateMu.Lock()
+	out := t.runOutput
+	t.stateMu.Unlock()
+	if out != nil {
+		return out.rotate()
 	}
 	return nil
 }
@@ -302,6 +986,11 @@ func (t *TreeImpl) Reload(ctx context.Context) error {
 		return err
 	}
 
+	if newConfig.OutputBufferLines != t.config.OutputBufferLines {
+		t.outputMu.Lock()
+		t.output = t.output.resize(newConfig.OutputBufferLines)
+		t.outputMu.Unlock()
+	}
 	t.config = newConfig
 	t.Restart(ctx)
 	return nil
@@ -0,0 +1,451 @@
+package tree_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	tree "github.com/mpoegel/pine/pkg/tree"
+)
+
+func runUntilStopped(t *testing.T, treeImpl *tree.TreeImpl, wait time.Duration) time.Duration {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+
+	time.Sleep(wait)
+	stoppedAt := time.Now()
+	noErr(t, treeImpl.Stop(context.Background()))
+
+	select {
+	case <-errChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tree did not stop")
+	}
+	return time.Since(stoppedAt)
+}
+
+func TestStopSignal(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Stopper\nCommand sleep 30\nStopTimeout 2s\n"))
+	noErr(t, err)
+
+	if elapsed := runUntilStopped(t, treeImpl, 200*time.Millisecond); elapsed > time.Second {
+		t.Errorf("stop took too long: %s", elapsed)
+	}
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.State != tree.StoppedState {
+		t.Errorf("unexpected state: %s", status.State)
+	}
+	if status.ExitReason != tree.StoppedReason {
+		t.Errorf("unexpected exit reason: %s", status.ExitReason)
+	}
+}
+
+func TestStopTimeoutKills(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Stubborn\nCommand sh -c 'trap \"\" USR1; exec sleep 30'\nStopSignal SIGUSR1\nStopTimeout 300ms\n"))
+	noErr(t, err)
+
+	if elapsed := runUntilStopped(t, treeImpl, 200*time.Millisecond); elapsed < 300*time.Millisecond {
+		t.Errorf("tree was killed before the stop timeout: %s", elapsed)
+	}
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.ExitReason != tree.KilledReason {
+		t.Errorf("unexpected exit reason: %s", status.ExitReason)
+	}
+}
+
+func cpuTime(t *testing.T) time.Duration {
+	var usage syscall.Rusage
+	noErr(t, syscall.Getrusage(syscall.RUSAGE_SELF, &usage))
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+func TestDestroyWaitsIdle(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Stubborn\nCommand sh -c 'trap \"\" TERM; exec sleep 30'\nStopTimeout 1s\n"))
+	noErr(t, err)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	before := cpuTime(t)
+	noErr(t, treeImpl.Destroy(context.Background()))
+	select {
+	case <-errChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tree did not stop")
+	}
+	// waiting out the stop timeout must not spin on the closed stop channel
+	if used := cpuTime(t) - before; used > 300*time.Millisecond {
+		t.Errorf("destroy used %s of CPU time", used)
+	}
+}
+
+func startChild(t *testing.T, killMode string) (*tree.TreeImpl, string) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Forker\nCommand sh -c 'sleep 30 & echo $! > "+pidFile+"; wait'\nKillMode "+killMode+"\nStopTimeout 1s\n"))
+	noErr(t, err)
+	return treeImpl, pidFile
+}
+
+func childPid(t *testing.T, pidFile string) int {
+	data, err := os.ReadFile(pidFile)
+	noErr(t, err)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	noErr(t, err)
+	return pid
+}
+
+func processAlive(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	return err == nil && !strings.Contains(string(data), ") Z ")
+}
+
+func TestKillModeGroup(t *testing.T) {
+	treeImpl, pidFile := startChild(t, "group")
+	runUntilStopped(t, treeImpl, 200*time.Millisecond)
+
+	if pid := childPid(t, pidFile); processAlive(pid) {
+		syscall.Kill(pid, syscall.SIGKILL)
+		t.Errorf("child process %d survived stop", pid)
+	}
+}
+
+func TestKillModeProcess(t *testing.T) {
+	treeImpl, pidFile := startChild(t, "process")
+	runUntilStopped(t, treeImpl, 200*time.Millisecond)
+
+	pid := childPid(t, pidFile)
+	if !processAlive(pid) {
+		t.Errorf("child process %d should survive in process kill mode", pid)
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+}
+
+func TestStatusAfterExit(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Failer\nCommand sh -c 'exit 3'\n"))
+	noErr(t, err)
+
+	before, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+
+	time.Sleep(10 * time.Millisecond)
+	if err := treeImpl.Start(context.Background()); err == nil {
+		t.Error("expected exit error")
+	}
+
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.State != tree.StoppedState {
+		t.Errorf("unexpected state: %s", status.State)
+	}
+	if status.ExitCode != 3 || status.ExitReason != tree.ExitedReason {
+		t.Errorf("unexpected exit: code=%d reason=%s", status.ExitCode, status.ExitReason)
+	}
+	if status.RunCount != 1 {
+		t.Errorf("unexpected run count: %d", status.RunCount)
+	}
+	if status.LastError != "exit status 3" {
+		t.Errorf("unexpected last error: '%s'", status.LastError)
+	}
+	if status.Pid != 0 {
+		t.Errorf("unexpected pid after exit: %d", status.Pid)
+	}
+	if !status.LastChange.After(before.LastChange) {
+		t.Errorf("last change was not updated: %s", status.LastChange)
+	}
+}
+
+// holderRunning reports whether a process holds the output of the tree
+// running as pid.
+func holderRunning(pid int) bool {
+	matches, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, match := range matches {
+		cmdline, err := os.ReadFile(match)
+		if err == nil && strings.HasPrefix(string(cmdline), "pine-output\x00"+strconv.Itoa(pid)+"\x00") {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOutputHolder(t *testing.T) {
+	filename := createTreeFile(t, "Name Holder\nShell yes\nCommand test -e /proc/$$/fd/3 && echo leaked; echo done; sleep 30\n")
+	treeImpl, err := tree.NewTree(filename)
+	noErr(t, err)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+
+	if data := readLog(t, filepath.Join(filepath.Dir(filename), "test.log"), 1); string(data) != "done\n" {
+		t.Errorf("tree inherited descriptors beyond its standard streams: %q", data)
+	}
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if !holderRunning(status.Pid) {
+		t.Errorf("no process holds the output of %d", status.Pid)
+	}
+
+	noErr(t, treeImpl.Stop(context.Background()))
+	select {
+	case <-errChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tree did not stop")
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for holderRunning(status.Pid) {
+		if time.Now().After(deadline) {
+			t.Fatal("output holder did not exit after the tree")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestStatusWhileRunning(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Runner\nCommand sleep 30\n"))
+	noErr(t, err)
+
+	go treeImpl.Start(context.Background())
+	defer treeImpl.Stop(context.Background())
+	time.Sleep(200 * time.Millisecond)
+
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.State != tree.RunningState {
+		t.Errorf("unexpected state: %s", status.State)
+	}
+	if status.Pid == 0 || !processAlive(status.Pid) {
+		t.Errorf("unexpected pid: %d", status.Pid)
+	}
+}
+
+func TestCrashLoop(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Crasher\nCommand false\nRestart always\nRestartDelay 10ms\nRestartLimitBurst 3\nRestartLimitInterval 10s\n"))
+	noErr(t, err)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+	select {
+	case err := <-errChan:
+		if err == nil || !strings.Contains(err.Error(), "crash loop") {
+			t.Errorf("expected crash loop error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		treeImpl.Stop(context.Background())
+		t.Fatal("tree did not enter crash loop")
+	}
+
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.State != tree.CrashLoopState {
+		t.Errorf("unexpected state: %s", status.State)
+	}
+	if status.RunCount != 4 {
+		t.Errorf("unexpected run count: %d", status.RunCount)
+	}
+}
+
+func TestCrashLoopByDefault(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Crasher\nCommand false\nRestart always\nRestartDelay 10ms\n"))
+	noErr(t, err)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+	select {
+	case err := <-errChan:
+		if err == nil || !strings.Contains(err.Error(), "crash loop") {
+			t.Errorf("expected crash loop error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		treeImpl.Stop(context.Background())
+		t.Fatal("tree did not enter crash loop")
+	}
+
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.State != tree.CrashLoopState || status.RunCount != 6 {
+		t.Errorf("unexpected state %s after %d runs", status.State, status.RunCount)
+	}
+}
+
+func TestRestartBackoff(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Backoff\nCommand false\nRestart limited\nRestartAttempts 5\nRestartDelay 20ms\nRestartBackoff 2\nRestartMaxDelay 50ms\n"))
+	noErr(t, err)
+
+	start := time.Now()
+	treeImpl.Start(context.Background())
+	// delays of 20ms, 40ms, 50ms and 50ms between the five runs
+	if elapsed := time.Since(start); elapsed < 160*time.Millisecond {
+		t.Errorf("restarts did not back off: %s", elapsed)
+	}
+}
+
+func TestRestartPolicies(t *testing.T) {
+	tests := []struct {
+		restart string
+		command string
+		extra   string
+		runs    int
+	}{
+		{"on-failure", "true", "", 1},
+		{"on-failure", "false", "", 3},
+		{"on-failure", "sh -c 'exit 3'", "SuccessExitStatus 3 SIGUSR1\n", 1},
+		{"on-failure", "sh -c 'kill -TERM $$'", "", 1},
+		{"on-failure", "sh -c 'kill -USR1 $$'", "", 3},
+		{"on-failure", "sh -c 'kill -USR1 $$'", "SuccessExitStatus USR1\n", 1},
+		{"on-success", "true", "", 3},
+		{"on-success", "false", "", 1},
+		{"on-abnormal", "false", "", 1},
+		{"on-abnormal", "sh -c 'kill -TERM $$'", "", 1},
+		{"on-abnormal", "sh -c 'kill -KILL $$'", "", 3},
+		{"on-abnormal", "sleep 30", "Type notify\nStartTimeout 100ms\n", 3},
+		{"on-abnormal", "sleep 30", "WatchdogSec 100ms\n", 3},
+	}
+	for _, tc := range tests {
+		// the restart limit stops trees that keep restarting after three runs
+		treeImpl, err := tree.NewTree(createTreeFile(t, "Name Policy\nCommand "+tc.command+"\nRestart "+tc.restart+"\nRestartDelay 1ms\nRestartLimitBurst 2\n"+tc.extra))
+		noErr(t, err)
+
+		treeImpl.Start(context.Background())
+		status, err := treeImpl.Status(context.Background())
+		noErr(t, err)
+		if status.RunCount != tc.runs {
+			t.Errorf("%s with '%s': expected %d runs, got %d", tc.restart, tc.command, tc.runs, status.RunCount)
+		}
+	}
+}
+
+func TestRestartRequestIgnoresPolicy(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Requested\nCommand sleep 30\nRestart on-failure\nRestartDelay 1ms\n"))
+	noErr(t, err)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+	noErr(t, treeImpl.Restart(context.Background()))
+	time.Sleep(200 * time.Millisecond)
+
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.State != tree.RunningState || status.RunCount != 2 {
+		t.Errorf("tree was not restarted: state=%s runs=%d", status.State, status.RunCount)
+	}
+	noErr(t, treeImpl.Stop(context.Background()))
+	<-errChan
+}
+
+func TestOneshot(t *testing.T) {
+	for _, tc := range []struct {
+		command  string
+		state    tree.State
+		exitCode int
+	}{
+		{"true", tree.SucceededState, 0},
+		{"sh -c 'exit 5'", tree.FailedState, 5},
+	} {
+		treeImpl, err := tree.NewTree(createTreeFile(t, "Name Job\nType oneshot\nCommand "+tc.command+"\n"))
+		noErr(t, err)
+		treeImpl.Start(context.Background())
+
+		status, err := treeImpl.Status(context.Background())
+		noErr(t, err)
+		if status.State != tc.state || status.ExitCode != tc.exitCode {
+			t.Errorf("%s: unexpected status: %s exit code %d", tc.command, status.State, status.ExitCode)
+		}
+	}
+}
+
+func TestOneshotRemainAfterExit(t *testing.T) {
+	treeImpl, err := tree.NewTree(createTreeFile(t, "Name Job\nType oneshot\nRemainAfterExit yes\nCommand true\n"))
+	noErr(t, err)
+
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- treeImpl.Start(context.Background())
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	select {
+	case <-errChan:
+		t.Fatal("tree did not remain after exit")
+	default:
+	}
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.State != tree.SucceededState || status.RunCount != 1 {
+		t.Errorf("unexpected status: %s run count %d", status.State, status.RunCount)
+	}
+
+	noErr(t, treeImpl.Stop(context.Background()))
+	select {
+	case <-errChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("tree did not stop")
+	}
+	status, err = treeImpl.Status(context.Background())
+	noErr(t, err)
+	if status.State != tree.StoppedState {
+		t.Errorf("unexpected state after stop: %s", status.State)
+	}
+}
+
+func TestProcessEnvironment(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing groups requires root")
+	}
+	dir := t.TempDir()
+	noErr(t, os.WriteFile(filepath.Join(dir, "run.sh"), []byte("#!/bin/sh\npwd; umask; id -g; id -G\n"), 0755))
+	filename := createTreeFile(t, "Name Env\nCommand ./run.sh\nWorkingDirectory "+dir+
+		"\nUMask 027\nGroup 1234\nSupplementaryGroups 4321\n")
+	treeImpl, err := tree.NewTree(filename)
+	noErr(t, err)
+	noErr(t, treeImpl.Start(context.Background()))
+
+	data := readLog(t, filepath.Join(filepath.Dir(filename), "test.log"), 4)
+	lines := strings.Split(string(data), "\n")
+	if len(lines) < 4 || lines[0] != dir || lines[1] != "0027" || lines[2] != "1234" {
+		t.Fatalf("unexpected output: %q", data)
+	}
+	groups := strings.Fields(lines[3])
+	if !slices.Contains(groups, "4321") || !slices.Contains(groups, strconv.Itoa(os.Getgid())) {
+		t.Errorf("expected the supplementary and the user's groups, got %q", groups)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	filename := createTreeFile(t, "Name Limits\nShell yes\nLimitNOFILE 512:1024\nLimitCORE 0\n"+
+		"Command ulimit -Sn; ulimit -Hn; ulimit -c; sleep 30\n")
+	treeImpl, err := tree.NewTree(filename)
+	noErr(t, err)
+	go treeImpl.Start(context.Background())
+	defer treeImpl.Stop(context.Background())
+
+	data := readLog(t, filepath.Join(filepath.Dir(filename), "test.log"), 3)
+	if string(data) != "512\n1024\n0\n" {
+		t.Errorf("unexpected limits: %q", data)
+	}
+	status, err := treeImpl.Status(context.Background())
+	noErr(t, err)
+	want := []tree.Limit{{Resource: "NOFILE", Soft: 512, Hard: 1024}, {Resource: "CORE"}}
+	if !slices.Equal(status.Limits, want) {
+		t.Errorf("unexpected status limits: %+v", status.Limits)
+	}
+}